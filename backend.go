@@ -0,0 +1,25 @@
+package portmapper
+
+import (
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Backend is the key-value store a Registry keeps services in. It is the part
+// of etcd's client.KeysAPI the registry uses, so any KeysAPI is a Backend,
+// and other stores can be adapted to it by mapping their keys, errors and
+// change notifications onto etcd's. The consul subpackage does this for
+// Consul's KV store.
+//
+// Keys are slash separated paths below the registry root. A Get of a
+// directory returns the entries below it as child nodes, recursively if
+// asked, and a missing key is a client.Error with ErrorCodeKeyNotFound.
+type Backend interface {
+	Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error)
+	Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error)
+	Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error)
+	Watcher(key string, opts *client.WatcherOptions) client.Watcher
+}
+
+// the etcd keys API is the default Backend
+var _ Backend = client.KeysAPI(nil)
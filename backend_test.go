@@ -0,0 +1,28 @@
+package portmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PackageFunctionsOverBackend(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+
+	defer useKeysAPI(NewMemoryBackend())()
+
+	assert.NoError(t, Register("serviceA", 1))
+	assert.NoError(t, RegisterAll([]*Service{{Name: "serviceB", Port: 2}}))
+
+	services, err := Services()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Service{
+		{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "host1", SchemaVersion: 1, ModifiedIndex: 1},
+		{Name: "serviceB", Port: 2, Protocol: ProtocolTCP, Hostname: "host1", SchemaVersion: 1, ModifiedIndex: 2},
+	}, services)
+
+	assert.NoError(t, Unregister("serviceA", 1))
+	services, err = Services()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(services))
+}
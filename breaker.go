@@ -0,0 +1,149 @@
+package portmapper
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// ErrCircuitOpen is wrapped by the errors of operations refused because the
+// registry's circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of a registry's circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every operation through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen refuses every operation until the cooldown is over.
+	BreakerOpen
+	// BreakerHalfOpen lets a single operation through to probe etcd,
+	// refusing the rest until it is done.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// WithCircuitBreaker makes the Registry stop sending requests to etcd once
+// threshold operations in a row have failed to reach it. While the breaker
+// is open every operation fails at once with an error wrapping
+// ErrCircuitOpen. After cooldown one operation is let through as a probe:
+// if etcd answers the breaker closes again, and if not it stays open for
+// another cooldown. An operation counts as failed when its retries run out
+// or it fails with anything other than an answer from etcd, such as a key
+// not being found; one cut short by its caller's context doesn't count
+// either way.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(r *Registry) {
+		r.breaker = &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+	}
+}
+
+// BreakerState returns the state of the registry's circuit breaker. It is
+// BreakerHalfOpen once an open breaker's cooldown is over, even before the
+// probe is made, and always BreakerClosed without WithCircuitBreaker.
+func (r *Registry) BreakerState() BreakerState {
+	if r.breaker == nil {
+		return BreakerClosed
+	}
+	return r.breaker.current()
+}
+
+// circuitBreaker tracks consecutive failures to reach etcd. Its fields are
+// guarded by mu.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// probing is set while the half-open probe is in flight
+	probing bool
+}
+
+// current returns the breaker's state, reporting an open breaker whose
+// cooldown is over as half-open.
+func (b *circuitBreaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether an operation may go ahead, and whether it is the
+// half-open probe. An operation that is allowed must be passed to done once
+// it finishes.
+func (b *circuitBreaker) allow() (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		b.state = BreakerHalfOpen
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+// done records the outcome of an allowed operation that was run with ctx
+// and failed with err, if it did. Failures of operations let through before
+// the breaker opened don't count against it again.
+func (b *circuitBreaker) done(ctx context.Context, probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+
+	var cerr client.Error
+	switch {
+	case err == nil || errors.As(err, &cerr):
+		if b.state != BreakerClosed {
+			logger().Info("Circuit breaker closed, etcd is answering again", Fields{"action": "CircuitBreaker"})
+		}
+		b.state, b.failures = BreakerClosed, 0
+	case ctx.Err() != nil:
+		// the caller gave up, which says nothing about etcd
+	case probe || b.state == BreakerClosed:
+		b.failures++
+		if probe || b.failures >= b.threshold {
+			logger().Warn("Circuit breaker opened, failing etcd requests fast", Fields{
+				"action":   "CircuitBreaker",
+				"failures": b.failures,
+				"cooldown": b.cooldown.String(),
+				"errstr":   err.Error(),
+			})
+			b.state, b.openedAt = BreakerOpen, b.now()
+		}
+	}
+}
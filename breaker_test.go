@@ -0,0 +1,121 @@
+package portmapper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_CircuitBreaker(t *testing.T) {
+	kapi := timeoutKeysAPI()
+	r := NewRegistry(kapi, WithFailFast(), WithCircuitBreaker(3, time.Minute))
+	now := time.Unix(1000, 0)
+	r.breaker.now = func() time.Time { return now }
+	open := func(err error) bool { return errors.Is(err, ErrCircuitOpen) }
+
+	// closed until threshold operations in a row fail
+	assert.Equal(t, BreakerClosed, r.BreakerState())
+	for i := 0; i < 3; i++ {
+		assert.False(t, open(r.Register("serviceA", 1)))
+	}
+	assert.Equal(t, BreakerOpen, r.BreakerState())
+	assert.Equal(t, "open", r.BreakerState().String())
+
+	// open, failing fast without reaching etcd
+	assert.True(t, open(r.Register("serviceA", 1)))
+	_, err := r.Services()
+	assert.True(t, open(err))
+	assert.Equal(t, 3, kapi.sets)
+	assert.Equal(t, 0, kapi.gets)
+
+	// half-open after the cooldown, and a failed probe opens it again
+	now = now.Add(time.Minute)
+	assert.Equal(t, BreakerHalfOpen, r.BreakerState())
+	assert.False(t, open(r.Register("serviceA", 1)))
+	assert.Equal(t, 4, kapi.sets)
+	assert.Equal(t, BreakerOpen, r.BreakerState())
+	assert.True(t, open(r.Register("serviceA", 1)))
+
+	// a probe etcd answers closes it
+	now = now.Add(time.Minute)
+	kapi.set = func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+		return &client.Response{}, nil
+	}
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.Equal(t, BreakerClosed, r.BreakerState())
+	assert.NoError(t, r.Register("serviceA", 2))
+
+	// and any success starts the count over
+	succeed := kapi.set
+	kapi.set = timeoutKeysAPI().set
+	for i := 0; i < 2; i++ {
+		assert.Error(t, r.Register("serviceA", 1))
+	}
+	kapi.set = succeed
+	assert.NoError(t, r.Register("serviceA", 1))
+	kapi.set = timeoutKeysAPI().set
+	assert.Error(t, r.Register("serviceA", 1))
+	assert.Error(t, r.Register("serviceA", 1))
+	assert.Equal(t, BreakerClosed, r.BreakerState())
+}
+
+func Test_CircuitBreakerCountsOnlyUnreachable(t *testing.T) {
+	kapi := &fakeKeysAPI{
+		set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+			return nil, client.Error{Code: client.ErrorCodeNodeExist}
+		},
+		delete: func(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+	r := NewRegistry(kapi, WithCircuitBreaker(2, time.Minute))
+
+	// etcd refusing a write is still etcd answering
+	for i := 0; i < 5; i++ {
+		assert.True(t, errors.Is(r.RegisterExclusive("serviceA", 1), ErrAlreadyRegistered))
+	}
+	assert.Equal(t, BreakerClosed, r.BreakerState())
+
+	// a cancelled caller says nothing about etcd
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 5; i++ {
+		assert.Error(t, r.UnregisterContext(ctx, "serviceA", 1))
+	}
+	assert.Equal(t, BreakerClosed, r.BreakerState())
+
+	// failing to reach it at all does count
+	assert.Error(t, r.Unregister("serviceA", 1))
+	assert.Error(t, r.Unregister("serviceA", 1))
+	assert.Equal(t, BreakerOpen, r.BreakerState())
+
+	assert.Equal(t, BreakerClosed, NewInMemoryRegistry().BreakerState())
+}
+
+func Test_CircuitBreakerSingleProbe(t *testing.T) {
+	release := make(chan struct{})
+	probing := make(chan struct{})
+	kapi := &fakeKeysAPI{set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+		close(probing)
+		<-release
+		return &client.Response{}, nil
+	}}
+	r := NewRegistry(kapi, WithCircuitBreaker(1, 0))
+	r.breaker.state = BreakerOpen
+
+	done := make(chan error)
+	go func() { done <- r.Register("serviceA", 1) }()
+	<-probing
+
+	// everything else is refused while the probe is out
+	assert.True(t, errors.Is(r.Register("serviceB", 2), ErrCircuitOpen))
+	assert.Equal(t, BreakerHalfOpen, r.BreakerState())
+
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, BreakerClosed, r.BreakerState())
+}
@@ -0,0 +1,85 @@
+package portmapper
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrRetryBudgetExhausted is wrapped by the errors of operations cut short
+// because the registry's retry budget has run out.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// WithRetryBudget caps the retries the Registry makes across all of its
+// operations at perSecond, with bursts of up to burst. Every retry spends a
+// token from a shared bucket that refills at perSecond. An operation that
+// finds the bucket empty fails at once with an error wrapping
+// ErrRetryBudgetExhausted, and does so before its first attempt if the
+// bucket is already empty, so a widespread etcd outage doesn't have every
+// caller retrying against a struggling cluster. First attempts cost
+// nothing, so a healthy cluster never drains the budget.
+func WithRetryBudget(perSecond float64, burst int) Option {
+	return func(r *Registry) {
+		r.budget = &retryBudget{
+			rate:   perSecond,
+			burst:  float64(burst),
+			tokens: float64(burst),
+			now:    time.Now,
+		}
+		r.budget.last = r.budget.now()
+	}
+}
+
+// retryBudget is a token bucket shared by a registry's retries.
+type retryBudget struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// refill adds the tokens earned since the last refill. The caller holds mu.
+func (b *retryBudget) refill() {
+	now := b.now()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// available reports whether a retry could be paid for now.
+func (b *retryBudget) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return b.tokens >= 1
+}
+
+// take spends a token on a retry, reporting false if there is none.
+func (b *retryBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// exhausted returns the error for an operation stopped by the budget after
+// attempts attempts, the last of which failed with err.
+func exhausted(what string, attempts int, err error) error {
+	if attempts == 0 {
+		return fmt.Errorf("service %s not attempted: %w", what, ErrRetryBudgetExhausted)
+	}
+	return fmt.Errorf("service %s stopped after %d attempts, %w: %w", what, attempts, ErrRetryBudgetExhausted, err)
+}
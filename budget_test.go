@@ -0,0 +1,90 @@
+package portmapper
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_RetryBudget(t *testing.T) {
+	waits, restore := countWaits()
+	defer restore()
+
+	kapi := timeoutKeysAPI()
+	r := NewRegistry(kapi, WithRetryBudget(1, 3), WithRetryPolicy(RetryPolicy{MaxRetries: 3, Timeout: time.Second}))
+	now := time.Unix(1000, 0)
+	r.budget.now = func() time.Time { return now }
+	r.budget.last = now
+
+	// the first call retries as usual, spending two of the three tokens
+	err := r.Register("serviceA", 1)
+	var rerr *RetryError
+	assert.True(t, errors.As(err, &rerr), "%v", err)
+	assert.Equal(t, 3, kapi.sets)
+
+	// the next runs out part way, and shares the budget across operations
+	_, err = r.Services()
+	assert.True(t, errors.Is(err, ErrRetryBudgetExhausted), "%v", err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.Equal(t, 2, kapi.gets)
+	assert.Equal(t, 3, *waits)
+
+	// then calls fail without reaching the store
+	for i := 0; i < 5; i++ {
+		assert.True(t, errors.Is(r.Register("serviceA", 1), ErrRetryBudgetExhausted))
+		assert.True(t, errors.Is(r.Unregister("serviceA", 1), ErrRetryBudgetExhausted))
+	}
+	assert.Equal(t, 3, kapi.sets)
+	assert.Equal(t, 0, kapi.deletes)
+
+	// until the bucket refills
+	now = now.Add(1500 * time.Millisecond)
+	assert.True(t, errors.Is(r.Register("serviceA", 1), ErrRetryBudgetExhausted))
+	assert.Equal(t, 5, kapi.sets)
+
+	// a healthy store spends nothing
+	r = NewRegistry(NewMemoryBackend(), WithRetryBudget(0, 1))
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, r.Register("serviceA", 1))
+	}
+}
+
+// timeoutSets is a Backend whose sets all time out, counting them safely
+// for concurrent use.
+type timeoutSets struct {
+	Backend
+	mu   sync.Mutex
+	sets int
+}
+
+func (b *timeoutSets) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sets++
+	return nil, context.DeadlineExceeded
+}
+
+func Test_RetryBudgetConcurrent(t *testing.T) {
+	backend := &timeoutSets{Backend: NewMemoryBackend()}
+	r := NewRegistry(backend, WithRetryBudget(0, 10),
+		WithRetryPolicy(RetryPolicy{MaxRetries: 3, Timeout: time.Second, BackoffBase: time.Microsecond}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Error(t, r.Register("serviceA", 1))
+		}()
+	}
+	wg.Wait()
+
+	// each call made at most one attempt the budget didn't pay for
+	assert.True(t, backend.sets <= 20+10, "made %d requests", backend.sets)
+}
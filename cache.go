@@ -0,0 +1,68 @@
+package portmapper
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL is how long ServicesCached reuses a result from etcd unless
+// WithCacheTTL says otherwise.
+const DefaultCacheTTL = 5 * time.Second
+
+// servicesCache holds the last Services result for ServicesCached. mu is held
+// across a refresh, so concurrent callers wait for one etcd request rather
+// than each making their own.
+type servicesCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	services []*Service
+	fetched  time.Time
+	now      func() time.Time
+}
+
+// WithCacheTTL sets how long ServicesCached reuses a result before asking
+// etcd again. Zero or less keeps DefaultCacheTTL.
+func WithCacheTTL(d time.Duration) Option {
+	return func(r *Registry) {
+		if d > 0 {
+			r.cache.ttl = d
+		}
+	}
+}
+
+// ServicesCached is like Services but serves a result up to the cache TTL
+// old, for hot paths that would otherwise hit etcd on every call. Changes,
+// including this registry's own writes, show up once the result expires or
+// InvalidateCache is called. Failures are not cached.
+func (r *Registry) ServicesCached() ([]*Service, error) {
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+
+	if r.cache.services == nil || !r.cache.now().Before(r.cache.fetched.Add(r.cache.ttl)) {
+		services, err := r.Services()
+		if err != nil {
+			return nil, err
+		}
+		if services == nil {
+			services = []*Service{}
+		}
+		r.cache.services = services
+		r.cache.fetched = r.cache.now()
+	}
+
+	// callers may change what they get back, so hand out copies
+	services := make([]*Service, len(r.cache.services))
+	for i, svc := range r.cache.services {
+		services[i] = svc.Clone()
+	}
+	return services, nil
+}
+
+// InvalidateCache drops the result held for ServicesCached, so the next call
+// asks etcd.
+func (r *Registry) InvalidateCache() {
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+
+	r.cache.services = nil
+}
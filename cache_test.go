@@ -0,0 +1,86 @@
+package portmapper
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_ServicesCached(t *testing.T) {
+	registered := []*Service{{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, SchemaVersion: 1}}
+	kapi := &fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		return registryGet(registered...)(ctx, key, opts)
+	}}
+	now := time.Unix(1000, 0)
+	r := NewRegistry(kapi, WithCacheTTL(time.Minute))
+	r.cache.now = func() time.Time { return now }
+
+	services, err := r.ServicesCached()
+	assert.NoError(t, err)
+	assert.Equal(t, registered, services)
+	assert.Equal(t, 1, kapi.gets)
+
+	// served from the cache within the TTL, as copies
+	registered = append(registered, &Service{Name: "serviceB", Port: 2, Protocol: ProtocolTCP, SchemaVersion: 1})
+	now = now.Add(59 * time.Second)
+	services[0].Port = 2
+	services, err = r.ServicesCached()
+	assert.NoError(t, err)
+	assert.Equal(t, registered[:1], services)
+	assert.Equal(t, 1, kapi.gets)
+
+	// refreshed once it expires
+	now = now.Add(time.Second)
+	services, err = r.ServicesCached()
+	assert.NoError(t, err)
+	assert.Equal(t, registered, services)
+	assert.Equal(t, 2, kapi.gets)
+
+	// and when invalidated
+	registered = registered[1:]
+	r.InvalidateCache()
+	services, err = r.ServicesCached()
+	assert.NoError(t, err)
+	assert.Equal(t, registered, services)
+	assert.Equal(t, 3, kapi.gets)
+}
+
+func Test_ServicesCachedSkipsFailures(t *testing.T) {
+	_, restore := countWaits()
+	defer restore()
+
+	kapi := timeoutKeysAPI()
+	r := NewRegistry(kapi)
+	_, err := r.ServicesCached()
+	assert.Error(t, err)
+
+	kapi.get = registryGet()
+	services, err := r.ServicesCached()
+	assert.NoError(t, err)
+	assert.Empty(t, services)
+	assert.Equal(t, MaxRetries+1, kapi.gets)
+}
+
+func Test_ServicesCachedConcurrent(t *testing.T) {
+	kapi := &fakeKeysAPI{get: registryGet(&Service{Name: "serviceA", Port: 1})}
+	r := NewRegistry(kapi)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			services, err := r.ServicesCached()
+			assert.NoError(t, err)
+			assert.Len(t, services, 1)
+			r.InvalidateCache()
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, kapi.gets >= 1 && kapi.gets <= 20, "made %d requests", kapi.gets)
+}
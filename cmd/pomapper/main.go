@@ -0,0 +1,180 @@
+// Command pomapper registers, unregisters and lists services in the etcd
+// backed portmapper registry.
+//
+// Usage:
+//
+//	pomapper [-etcd endpoints] [-v] register -name NAME -port PORT
+//	pomapper [-etcd endpoints] [-v] unregister -name NAME -port PORT
+//	pomapper [-etcd endpoints] [-v] list [-json]
+//
+// Endpoints default to ETCD_HOST, a comma-separated list.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	portmapper "github.com/opsee/pomapper"
+)
+
+// registry is the part of the portmapper API the commands use.
+type registry interface {
+	Register(name string, port int) error
+	Unregister(name string, port int) error
+	Services() ([]*portmapper.Service, error)
+}
+
+// packageRegistry is a registry backed by the package-level functions.
+type packageRegistry struct{}
+
+func (packageRegistry) Register(name string, port int) error {
+	return portmapper.Register(name, port)
+}
+
+func (packageRegistry) Unregister(name string, port int) error {
+	return portmapper.Unregister(name, port)
+}
+
+func (packageRegistry) Services() ([]*portmapper.Service, error) {
+	return portmapper.Services()
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr, connect))
+}
+
+// connect configures the package for endpoints, if any were given, and
+// returns a registry over it.
+func connect(endpoints []string) (registry, error) {
+	if len(endpoints) > 0 {
+		portmapper.SetEndpoints(endpoints)
+	}
+	return packageRegistry{}, nil
+}
+
+// errUsage means the command line was wrong and usage has been printed.
+var errUsage = errors.New("usage")
+
+// run executes the command line in args and returns the process exit code.
+func run(args []string, stdout, stderr io.Writer, connect func([]string) (registry, error)) int {
+	global := flag.NewFlagSet("pomapper", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.Usage = func() {
+		fmt.Fprintln(stderr, "usage: pomapper [-etcd endpoints] [-v] register|unregister|list [flags]")
+		global.PrintDefaults()
+	}
+	etcd := global.String("etcd", "", "comma-separated etcd endpoints (default $ETCD_HOST)")
+	verbose := global.Bool("v", false, "log portmapper activity to stderr")
+	if err := global.Parse(args); err != nil {
+		return 2
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return 2
+	}
+
+	if !*verbose {
+		portmapper.SetLogger(nil)
+	}
+
+	var endpoints []string
+	if *etcd != "" {
+		endpoints = portmapper.ParseEndpoints(*etcd)
+	}
+	reg, err := connect(endpoints)
+	if err != nil {
+		fmt.Fprintln(stderr, "pomapper:", err)
+		return 1
+	}
+
+	cmd, cmdArgs := global.Arg(0), global.Args()[1:]
+	switch cmd {
+	case "register":
+		err = registerCmd(reg, cmdArgs, stderr)
+	case "unregister":
+		err = unregisterCmd(reg, cmdArgs, stderr)
+	case "list":
+		err = listCmd(reg, cmdArgs, stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "pomapper: unknown command %q\n", cmd)
+		global.Usage()
+		return 2
+	}
+
+	if err == errUsage {
+		return 2
+	} else if err != nil {
+		fmt.Fprintf(stderr, "pomapper %s: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+// serviceFlags parses the -name and -port flags shared by register and
+// unregister.
+func serviceFlags(cmd string, args []string, stderr io.Writer) (string, int, error) {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	name := fs.String("name", "", "service name")
+	port := fs.Int("port", 0, "service port")
+	if err := fs.Parse(args); err != nil {
+		return "", 0, errUsage
+	}
+	if *name == "" || *port == 0 {
+		fmt.Fprintf(stderr, "pomapper %s: -name and -port are required\n", cmd)
+		fs.PrintDefaults()
+		return "", 0, errUsage
+	}
+
+	return *name, *port, nil
+}
+
+func registerCmd(reg registry, args []string, stderr io.Writer) error {
+	name, port, err := serviceFlags("register", args, stderr)
+	if err != nil {
+		return err
+	}
+	return reg.Register(name, port)
+}
+
+func unregisterCmd(reg registry, args []string, stderr io.Writer) error {
+	name, port, err := serviceFlags("unregister", args, stderr)
+	if err != nil {
+		return err
+	}
+	return reg.Unregister(name, port)
+}
+
+func listCmd(reg registry, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	asJSON := fs.Bool("json", false, "print services as a JSON array")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	services, err := reg.Services()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		bytes, err := portmapper.MarshalServices(services)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(stdout, "%s\n", bytes)
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPORT\tPROTOCOL\tHOSTNAME")
+	for _, svc := range services {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", svc.Name, svc.Port, svc.Protocol, svc.Hostname)
+	}
+	return w.Flush()
+}
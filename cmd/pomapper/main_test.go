@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	portmapper "github.com/opsee/pomapper"
+)
+
+// fakeRegistry records calls and serves a fixed service list.
+type fakeRegistry struct {
+	services   []*portmapper.Service
+	err        error
+	registered []string
+}
+
+func (f *fakeRegistry) Register(name string, port int) error {
+	f.registered = append(f.registered, name)
+	return f.err
+}
+
+func (f *fakeRegistry) Unregister(name string, port int) error {
+	return f.err
+}
+
+func (f *fakeRegistry) Services() ([]*portmapper.Service, error) {
+	return f.services, f.err
+}
+
+// runFake runs args against reg and returns the exit code and output.
+func runFake(reg *fakeRegistry, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr, func([]string) (registry, error) { return reg, nil })
+	return code, stdout.String(), stderr.String()
+}
+
+func Test_List(t *testing.T) {
+	reg := &fakeRegistry{services: []*portmapper.Service{
+		{Name: "serviceA", Port: 1, Protocol: "tcp", Hostname: "host1", SchemaVersion: 1},
+		{Name: "serviceB", Port: 53, Protocol: "udp", SchemaVersion: 1},
+	}}
+
+	code, stdout, _ := runFake(reg, "list")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "NAME      PORT  PROTOCOL  HOSTNAME\n"+
+		"serviceA  1     tcp       host1\n"+
+		"serviceB  53    udp       \n", stdout)
+
+	code, stdout, _ = runFake(reg, "list", "-json")
+	assert.Equal(t, 0, code)
+	var services []*portmapper.Service
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &services))
+	assert.Equal(t, reg.services, services)
+}
+
+func Test_ListFailure(t *testing.T) {
+	code, _, stderr := runFake(&fakeRegistry{err: errors.New("etcd is down")}, "list")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "etcd is down")
+}
+
+func Test_Register(t *testing.T) {
+	reg := &fakeRegistry{}
+	code, _, _ := runFake(reg, "register", "-name", "serviceA", "-port", "1")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, []string{"serviceA"}, reg.registered)
+
+	code, _, _ = runFake(reg, "register", "-name", "serviceA")
+	assert.Equal(t, 2, code)
+
+	code, _, _ = runFake(reg, "bogus")
+	assert.Equal(t, 2, code)
+
+	code, _, _ = runFake(&fakeRegistry{err: errors.New("nope")}, "unregister", "-name", "serviceA", "-port", "1")
+	assert.Equal(t, 1, code)
+}
+
+func Test_EtcdFlag(t *testing.T) {
+	var endpoints []string
+	connect := func(e []string) (registry, error) {
+		endpoints = e
+		return &fakeRegistry{}, nil
+	}
+	var stdout, stderr bytes.Buffer
+
+	// split like ETCD_HOST, on commas and whitespace
+	run([]string{"-etcd", "http://10.0.0.1:2379, http://10.0.0.2:2379,", "list"}, &stdout, &stderr, connect)
+	assert.Equal(t, []string{"http://10.0.0.1:2379", "http://10.0.0.2:2379"}, endpoints)
+
+	run([]string{"list"}, &stdout, &stderr, connect)
+	assert.Nil(t, endpoints)
+}
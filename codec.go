@@ -0,0 +1,34 @@
+package portmapper
+
+// Codec encodes the Service stored at each etcd key. The key layout doesn't
+// depend on it, only the value does. etcd v2 carries values as text, so a
+// binary encoding such as protobuf should be wrapped in something like
+// base64.
+type Codec interface {
+	Marshal(*Service) ([]byte, error)
+	Unmarshal([]byte) (*Service, error)
+}
+
+// JSONCodec is the default Codec, storing services as Service.Marshal does.
+type JSONCodec struct{}
+
+// Marshal encodes svc as JSON.
+func (JSONCodec) Marshal(svc *Service) ([]byte, error) {
+	return svc.Marshal()
+}
+
+// Unmarshal decodes a JSON service.
+func (JSONCodec) Unmarshal(bytes []byte) (*Service, error) {
+	return UnmarshalService(bytes)
+}
+
+// WithCodec makes the Registry encode stored services with c rather than
+// JSONCodec. Every reader and writer of a registry must agree on its codec.
+// Nil keeps JSONCodec.
+func WithCodec(c Codec) Option {
+	return func(r *Registry) {
+		if c != nil {
+			r.codec = c
+		}
+	}
+}
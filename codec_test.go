@@ -0,0 +1,51 @@
+package portmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pipeCodec stores services as name|port|hostname.
+type pipeCodec struct{}
+
+func (pipeCodec) Marshal(svc *Service) ([]byte, error) {
+	return []byte(fmt.Sprintf("%s|%d|%s", svc.Name, svc.Port, svc.Hostname)), nil
+}
+
+func (pipeCodec) Unmarshal(bytes []byte) (*Service, error) {
+	parts := strings.Split(string(bytes), "|")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed value %q", bytes)
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &Service{Name: parts[0], Port: port, Hostname: parts[2]}, nil
+}
+
+func Test_WithCodec(t *testing.T) {
+	backend := NewMemoryBackend()
+	r := NewRegistry(backend, WithCodec(pipeCodec{}))
+	assert.NoError(t, r.RegisterWithHostname("serviceA", 1, "host1"))
+
+	// the key is unchanged, only the value
+	if entry, ok := backend.entries[RegistryPath+"/serviceA/tcp:1"]; assert.True(t, ok) {
+		assert.Equal(t, "serviceA|1|host1", entry.value)
+	}
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, "serviceA:1/tcp@host1", services[0].String())
+	}
+
+	// a JSON registry can't make sense of the value, so skips it
+	services, err = NewRegistry(backend).Services()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(services))
+}
@@ -0,0 +1,341 @@
+// Package consul adapts Consul's KV store to a portmapper.Backend, so a
+// Registry can keep services in Consul instead of etcd:
+//
+//	c, err := api.NewClient(api.DefaultConfig())
+//	...
+//	r := portmapper.NewRegistry(consul.New(c.KV()))
+//
+// Consul has no directories, so the registry's directories are implied by
+// the keys below them, and it has no key TTLs, so RegisterTTL and
+// RegisterWithKeepAlive fail against this backend.
+//
+// Consul keeps no history of changes, so a watch can't be replayed from an
+// earlier index. A watcher asked to start after an index fails with etcd's
+// ErrorCodeEventIndexCleared, and the current index, if anything below it
+// has changed since, leaving the caller to resync as it would when etcd has
+// cleared the index. Registry.Watch and Snapshot already do.
+package consul
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"github.com/hashicorp/consul/api"
+	"golang.org/x/net/context"
+
+	portmapper "github.com/opsee/pomapper"
+)
+
+// KV is the part of the Consul KV API the backend uses. *api.KV satisfies it.
+type KV interface {
+	Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error)
+	Keys(prefix, separator string, q *api.QueryOptions) ([]string, *api.QueryMeta, error)
+	List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error)
+	Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error)
+	CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+	Delete(key string, w *api.WriteOptions) (*api.WriteMeta, error)
+	DeleteTree(prefix string, w *api.WriteOptions) (*api.WriteMeta, error)
+}
+
+// ErrTTLUnsupported is returned for sets with a TTL, which Consul's KV store
+// can't expire.
+var ErrTTLUnsupported = errors.New("consul backend does not support key TTLs")
+
+// Backend is a portmapper.Backend over a Consul KV store.
+type Backend struct {
+	kv KV
+}
+
+var _ portmapper.Backend = (*Backend)(nil)
+
+// New returns a Backend storing keys in kv.
+func New(kv KV) *Backend {
+	return &Backend{kv: kv}
+}
+
+// consulKey maps an etcd style key to Consul's, which has no leading slash.
+func consulKey(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// etcdKey maps a Consul key back to the etcd style the registry uses.
+func etcdKey(key string) string {
+	return "/" + key
+}
+
+func notFound(key string, index uint64) error {
+	return client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key, Index: index}
+}
+
+func node(p *api.KVPair) *client.Node {
+	return &client.Node{
+		Key:           etcdKey(p.Key),
+		Value:         string(p.Value),
+		CreatedIndex:  p.CreateIndex,
+		ModifiedIndex: p.ModifyIndex,
+	}
+}
+
+// Get returns the value at key or, if key is a directory, the entries below
+// it as a tree of nodes.
+func (b *Backend) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	q := (&api.QueryOptions{}).WithContext(ctx)
+
+	if consulKey(key) == "" {
+		return b.getRoot(q)
+	}
+
+	pair, _, err := b.kv.Get(consulKey(key), q)
+	if err != nil {
+		return nil, err
+	}
+	if pair != nil {
+		return &client.Response{Action: "get", Node: node(pair)}, nil
+	}
+
+	// the listing's index is where a watch of key can start from
+	pairs, meta, err := b.kv.List(consulKey(key)+"/", q)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, notFound(key, meta.LastIndex)
+	}
+
+	return &client.Response{Action: "get", Node: tree(key, pairs, opts != nil && opts.Recursive), Index: meta.LastIndex}, nil
+}
+
+// getRoot lists the top level of the store. Consul can't get its root as a
+// key and listing it recursively would read everything, so only the names
+// below it are returned, without values.
+func (b *Backend) getRoot(q *api.QueryOptions) (*client.Response, error) {
+	keys, _, err := b.kv.Keys("", "/", q)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &client.Node{Key: "/", Dir: true}
+	for _, k := range keys {
+		root.Nodes = append(root.Nodes, &client.Node{Key: etcdKey(strings.TrimSuffix(k, "/")), Dir: strings.HasSuffix(k, "/")})
+	}
+
+	return &client.Response{Action: "get", Node: root}, nil
+}
+
+// tree arranges pairs below key into directory nodes. Unless recursive, only
+// key's immediate children are listed, and child directories are empty.
+func tree(key string, pairs api.KVPairs, recursive bool) *client.Node {
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+	key = strings.TrimRight(key, "/")
+	root := &client.Node{Key: key, Dir: true}
+	dirs := map[string]*client.Node{key: root}
+	dir := func(parent *client.Node, k string) *client.Node {
+		d, ok := dirs[k]
+		if !ok {
+			d = &client.Node{Key: k, Dir: true}
+			dirs[k] = d
+			parent.Nodes = append(parent.Nodes, d)
+		}
+		return d
+	}
+
+	for _, p := range pairs {
+		parts := strings.Split(strings.TrimPrefix(etcdKey(p.Key), key+"/"), "/")
+		if !recursive && len(parts) > 1 {
+			dir(root, key+"/"+parts[0])
+			continue
+		}
+
+		parent := root
+		for i := range parts[:len(parts)-1] {
+			parent = dir(parent, key+"/"+strings.Join(parts[:i+1], "/"))
+		}
+		parent.Nodes = append(parent.Nodes, node(p))
+	}
+
+	return root
+}
+
+// Set writes value at key. PrevNoExist and PrevExist are honoured with
+// Consul's check-and-set, failing as etcd would.
+func (b *Backend) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	if opts == nil {
+		opts = &client.SetOptions{}
+	}
+	if opts.TTL > 0 {
+		return nil, ErrTTLUnsupported
+	}
+
+	w := (&api.WriteOptions{}).WithContext(ctx)
+	pair := &api.KVPair{Key: consulKey(key), Value: []byte(value)}
+
+	switch opts.PrevExist {
+	case client.PrevNoExist:
+		// a ModifyIndex of 0 only succeeds if the key doesn't exist
+		ok, _, err := b.kv.CAS(pair, w)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, client.Error{Code: client.ErrorCodeNodeExist, Message: "Key already exists", Cause: key}
+		}
+	case client.PrevExist:
+		prev, _, err := b.kv.Get(pair.Key, (&api.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if prev == nil {
+			return nil, notFound(key, 0)
+		}
+		pair.ModifyIndex = prev.ModifyIndex
+		ok, _, err := b.kv.CAS(pair, w)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, client.Error{Code: client.ErrorCodeTestFailed, Message: "Compare failed", Cause: key}
+		}
+	default:
+		if _, err := b.kv.Put(pair, w); err != nil {
+			return nil, err
+		}
+	}
+
+	return &client.Response{Action: "set", Node: &client.Node{Key: key, Value: value}}, nil
+}
+
+// Delete removes key, or everything below it when opts.Recursive is set. A
+// missing key is an error, as it is with etcd.
+func (b *Backend) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	resp, err := b.Get(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w := (&api.WriteOptions{}).WithContext(ctx)
+	if resp.Node.Dir {
+		if opts == nil || !opts.Recursive {
+			return nil, client.Error{Code: client.ErrorCodeNotFile, Message: "Not a file", Cause: key}
+		}
+		if _, err := b.kv.DeleteTree(consulKey(key)+"/", w); err != nil {
+			return nil, err
+		}
+		return &client.Response{Action: "delete", Node: &client.Node{Key: key, Dir: true}}, nil
+	}
+
+	if _, err := b.kv.Delete(consulKey(key), w); err != nil {
+		return nil, err
+	}
+	return &client.Response{
+		Action:   "delete",
+		Node:     &client.Node{Key: key},
+		PrevNode: resp.Node,
+	}, nil
+}
+
+// Watcher returns a watcher for every key below key. It uses Consul's
+// blocking queries and reports the differences between successive listings,
+// so changes that are undone between two polls are not seen. The watch is
+// always recursive. With opts.AfterIndex set, Next fails with
+// ErrorCodeEventIndexCleared if the keys have changed since that index.
+func (b *Backend) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	w := &watcher{kv: b.kv, prefix: consulKey(key) + "/"}
+	if opts != nil {
+		w.after = opts.AfterIndex
+	}
+	return w
+}
+
+type watcher struct {
+	kv     KV
+	prefix string
+	// after is the index the caller has seen changes up to, if any
+	after   uint64
+	index   uint64
+	known   map[string]*api.KVPair
+	pending []*client.Response
+}
+
+// Next blocks until a key below the watched prefix changes and returns the
+// change. Changes that arrive together are returned one per call, in key
+// order.
+func (w *watcher) Next(ctx context.Context) (*client.Response, error) {
+	for len(w.pending) == 0 {
+		q := (&api.QueryOptions{WaitIndex: w.index}).WithContext(ctx)
+		pairs, meta, err := w.kv.List(w.prefix, q)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// the changes since after are gone, so the caller has to resync
+		if w.known == nil && w.after > 0 && meta.LastIndex > w.after {
+			return nil, client.Error{
+				Code:    client.ErrorCodeEventIndexCleared,
+				Message: "The event in requested index is outdated and cleared",
+				Cause:   etcdKey(strings.TrimSuffix(w.prefix, "/")),
+				Index:   meta.LastIndex,
+			}
+		}
+
+		current := make(map[string]*api.KVPair, len(pairs))
+		for _, p := range pairs {
+			current[p.Key] = p
+		}
+
+		// the first listing is where the watch starts, not a change
+		if w.known != nil {
+			w.pending = diff(w.known, current)
+		}
+		w.known = current
+
+		// an index that goes backwards means Consul reset it
+		if meta.LastIndex < w.index {
+			w.index = 0
+		} else {
+			w.index = meta.LastIndex
+		}
+	}
+
+	resp := w.pending[0]
+	w.pending = w.pending[1:]
+	return resp, nil
+}
+
+// diff returns etcd style responses turning before into after.
+func diff(before, after map[string]*api.KVPair) []*client.Response {
+	var keys []string
+	for k := range before {
+		keys = append(keys, k)
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []*client.Response
+	for _, k := range keys {
+		prev, now := before[k], after[k]
+		switch {
+		case now == nil:
+			changes = append(changes, &client.Response{
+				Action:   "delete",
+				Node:     &client.Node{Key: etcdKey(k), ModifiedIndex: prev.ModifyIndex},
+				PrevNode: node(prev),
+			})
+		case prev == nil:
+			changes = append(changes, &client.Response{Action: "set", Node: node(now)})
+		case now.ModifyIndex != prev.ModifyIndex:
+			changes = append(changes, &client.Response{Action: "set", Node: node(now), PrevNode: node(prev)})
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,297 @@
+package consul
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	portmapper "github.com/opsee/pomapper"
+)
+
+// fakeKV is an in-memory Consul KV store with blocking list queries.
+type fakeKV struct {
+	mu      sync.Mutex
+	index   uint64
+	pairs   map[string]*api.KVPair
+	changed chan struct{}
+
+	// listed receives a value, if there is room, once each List has read
+	// the store
+	listed chan struct{}
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{index: 1, pairs: map[string]*api.KVPair{}, changed: make(chan struct{}), listed: make(chan struct{}, 1)}
+}
+
+// bump records a change and wakes blocked queries. The caller holds mu.
+func (f *fakeKV) bump() uint64 {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return f.index
+}
+
+func (f *fakeKV) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key == "" {
+		return nil, nil, errors.New("missing key name")
+	}
+	if p, ok := f.pairs[key]; ok {
+		copied := *p
+		return &copied, &api.QueryMeta{LastIndex: f.index}, nil
+	}
+	return nil, &api.QueryMeta{LastIndex: f.index}, nil
+}
+
+func (f *fakeKV) Keys(prefix, separator string, q *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seen := map[string]bool{}
+	var keys []string
+	for k := range f.pairs {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if i := strings.Index(k[len(prefix):], separator); i >= 0 {
+			k = k[:len(prefix)+i+1]
+		}
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, &api.QueryMeta{LastIndex: f.index}, nil
+}
+
+func (f *fakeKV) List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	f.mu.Lock()
+	for q.WaitIndex != 0 && q.WaitIndex >= f.index {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-q.Context().Done():
+			return nil, nil, q.Context().Err()
+		}
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+	defer func() {
+		select {
+		case f.listed <- struct{}{}:
+		default:
+		}
+	}()
+
+	var pairs api.KVPairs
+	for k, p := range f.pairs {
+		if strings.HasPrefix(k, prefix) {
+			copied := *p
+			pairs = append(pairs, &copied)
+		}
+	}
+
+	return pairs, &api.QueryMeta{LastIndex: f.index}, nil
+}
+
+func (f *fakeKV) Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.put(p)
+	return &api.WriteMeta{}, nil
+}
+
+func (f *fakeKV) put(p *api.KVPair) {
+	index := f.bump()
+	stored := &api.KVPair{Key: p.Key, Value: p.Value, CreateIndex: index, ModifyIndex: index}
+	if prev, ok := f.pairs[p.Key]; ok {
+		stored.CreateIndex = prev.CreateIndex
+	}
+	f.pairs[p.Key] = stored
+}
+
+func (f *fakeKV) CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	prev, ok := f.pairs[p.Key]
+	if (p.ModifyIndex == 0 && ok) || (p.ModifyIndex != 0 && (!ok || prev.ModifyIndex != p.ModifyIndex)) {
+		return false, &api.WriteMeta{}, nil
+	}
+
+	f.put(p)
+	return true, &api.WriteMeta{}, nil
+}
+
+func (f *fakeKV) Delete(key string, w *api.WriteOptions) (*api.WriteMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.pairs, key)
+	f.bump()
+	return &api.WriteMeta{}, nil
+}
+
+func (f *fakeKV) DeleteTree(prefix string, w *api.WriteOptions) (*api.WriteMeta, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for k := range f.pairs {
+		if strings.HasPrefix(k, prefix) {
+			delete(f.pairs, k)
+		}
+	}
+	f.bump()
+	return &api.WriteMeta{}, nil
+}
+
+// drain empties ch without blocking.
+func drain(ch chan struct{}) {
+	for {
+		select {
+		case <-ch:
+		default:
+			return
+		}
+	}
+}
+
+func Test_RegistryOverConsul(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	kv := newFakeKV()
+	r := portmapper.NewRegistry(New(kv))
+
+	assert.NoError(t, r.Ping(context.Background()))
+
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.NoError(t, r.Register("serviceA", 2))
+	assert.NoError(t, r.RegisterExclusive("serviceB", 3))
+	assert.True(t, errors.Is(r.RegisterExclusive("serviceB", 3), portmapper.ErrAlreadyRegistered))
+	assert.Contains(t, kv.pairs, "opsee.co/portmapper/serviceA/tcp:1")
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(services))
+	count, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	registered, err := r.IsRegistered("serviceA", 2)
+	assert.NoError(t, err)
+	assert.True(t, registered)
+
+	svc := &portmapper.Service{Name: "serviceB", Port: 3, Hostname: "host1", Tags: map[string]string{"env": "prod"}}
+	assert.NoError(t, r.Refresh(svc))
+	assert.True(t, errors.Is(r.Refresh(&portmapper.Service{Name: "serviceC", Port: 4}), portmapper.ErrNotRegistered))
+
+	assert.NoError(t, r.Unregister("serviceB", 3))
+	// only succeeds again if the missing key maps to etcd's not-found error
+	assert.NoError(t, r.Unregister("serviceB", 3))
+
+	n, err := r.UnregisterService("serviceA")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	services, err = r.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(services))
+}
+
+func Test_ConsulRejectsTTL(t *testing.T) {
+	r := portmapper.NewRegistry(New(newFakeKV()))
+	assert.True(t, errors.Is(r.RegisterTTL("serviceA", 1, time.Minute), ErrTTLUnsupported))
+}
+
+func Test_ConsulWatch(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	kv := newFakeKV()
+	r := portmapper.NewRegistry(New(kv))
+	assert.NoError(t, r.Register("serviceA", 1))
+	drain(kv.listed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := r.Watch(ctx)
+	assert.NoError(t, err)
+
+	next := func() portmapper.ServiceEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+		return portmapper.ServiceEvent{}
+	}
+
+	// let the watch take its starting listing before changing anything
+	<-kv.listed
+
+	assert.NoError(t, r.Register("serviceB", 2))
+	event := next()
+	assert.Equal(t, portmapper.Added, event.Type)
+	assert.Equal(t, "serviceB", event.Service.Name)
+
+	assert.NoError(t, r.RegisterWithTags("serviceA", 1, map[string]string{"env": "prod"}))
+	event = next()
+	assert.Equal(t, portmapper.Modified, event.Type)
+	assert.Equal(t, "prod", event.Service.Tags["env"])
+
+	assert.NoError(t, r.Unregister("serviceB", 2))
+	event = next()
+	assert.Equal(t, portmapper.Deleted, event.Type)
+	assert.Equal(t, "serviceB", event.Service.Name)
+}
+
+func Test_ConsulWatchAfterIndex(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	kv := newFakeKV()
+	b := New(kv)
+	r := portmapper.NewRegistry(b)
+	assert.NoError(t, r.Register("serviceA", 1))
+	resp, err := b.Get(context.Background(), portmapper.RegistryPath, &client.GetOptions{Recursive: true})
+	assert.NoError(t, err)
+	index := resp.Index
+	assert.NotZero(t, index)
+
+	// nothing has changed since, so the watch picks up from there
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	w := b.Watcher(portmapper.RegistryPath, &client.WatcherOptions{Recursive: true, AfterIndex: index})
+	drain(kv.listed)
+	done := make(chan *client.Response)
+	go func() {
+		resp, err := w.Next(ctx)
+		assert.NoError(t, err)
+		done <- resp
+	}()
+	<-kv.listed
+	assert.NoError(t, r.Register("serviceB", 2))
+	if resp := <-done; assert.NotNil(t, resp) {
+		assert.Equal(t, portmapper.RegistryPath+"/serviceB/tcp:2", resp.Node.Key)
+	}
+
+	// changes since the index can't be replayed, so the caller must resync
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	w = b.Watcher(portmapper.RegistryPath, &client.WatcherOptions{Recursive: true, AfterIndex: index})
+	_, err = w.Next(ctx)
+	if cerr, ok := err.(client.Error); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, client.ErrorCodeEventIndexCleared, cerr.Code)
+		assert.Equal(t, kv.index, cerr.Index)
+	}
+}
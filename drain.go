@@ -0,0 +1,79 @@
+package portmapper
+
+import (
+	"fmt"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Drain marks the registration of (name, port) as Draining, so discovery
+// consumers stop sending it new requests while it finishes the ones it has.
+// The entry stays registered, tags, address and any remaining TTL included,
+// until Unregister is called once the drain period is over. It fails with an
+// error wrapping ErrNotRegistered if there is no such registration. A
+// RegisterWithKeepAlive registration stays draining through its refreshes.
+// The entry is rewritten as it is, so draining one another process
+// registered doesn't make it this registry's to Reregister.
+func (r *Registry) Drain(name string, port int) error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+
+	svc := &Service{Name: name, Port: port}
+	if err := svc.Validate(); err != nil {
+		return err
+	}
+
+	node, err := r.lookupNode(context.Background(), svc, "Drain")
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return fmt.Errorf("%w: %s", ErrNotRegistered, r.path(svc))
+	}
+
+	svc, err = serviceFromNode(r.root(), r.codec, node)
+	if err != nil {
+		return err
+	}
+	svc.Draining = true
+	bytes, err := r.codec.Marshal(svc)
+	if err != nil {
+		return err
+	}
+
+	fields := Fields{
+		"action":  "Drain",
+		"service": name,
+		"port":    port,
+		"path":    r.path(svc),
+	}
+	if r.dryRun {
+		logger().Info("Dry run: not draining service in etcd", fields.with(Fields{"value": string(bytes)}))
+		return nil
+	}
+
+	// keep the entry expiring when it would have
+	opts := &client.SetOptions{PrevExist: client.PrevExist, TTL: remainingTTL(node)}
+
+	// mark the keepalive first, so a refresh racing the write can't undo it
+	kept := r.drainKeepAlive(r.path(svc), true)
+	err = r.retry(context.Background(), "drain", fields, func(ctx context.Context) error {
+		_, err := r.backend.Set(ctx, r.path(svc), string(bytes), opts)
+		return err
+	})
+	if err != nil {
+		if kept {
+			r.drainKeepAlive(r.path(svc), false)
+		}
+		if isKeyNotFound(err) {
+			return fmt.Errorf("%w: %s", ErrNotRegistered, r.path(svc))
+		}
+		return err
+	}
+	r.drainOwned(r.path(svc))
+
+	logger().Info("Successfully drained service in etcd", fields)
+	return nil
+}
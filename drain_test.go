@@ -0,0 +1,103 @@
+package portmapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_Drain(t *testing.T) {
+	backend := NewMemoryBackend()
+	r := NewRegistry(backend)
+	assert.NoError(t, r.RegisterWithTags("serviceA", 1, map[string]string{"env": "prod"}))
+
+	assert.NoError(t, r.Drain("serviceA", 1))
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 1) {
+		assert.True(t, services[0].Draining)
+		assert.Equal(t, map[string]string{"env": "prod"}, services[0].Tags)
+	}
+	assert.Contains(t, backend.entries[RegistryPath+"/serviceA/tcp:1"].value, `"draining":true`)
+
+	// still registered until unregistered
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	assert.ErrorIs(t, r.Drain("serviceA", 1), ErrNotRegistered)
+}
+
+func Test_DrainKeepsTTL(t *testing.T) {
+	backend := NewMemoryBackend()
+	r := NewRegistry(backend)
+	assert.NoError(t, r.RegisterTTL("serviceA", 1, time.Minute))
+	expires := backend.entries[RegistryPath+"/serviceA/tcp:1"].expires
+
+	assert.NoError(t, r.Drain("serviceA", 1))
+	drained := backend.entries[RegistryPath+"/serviceA/tcp:1"].expires
+	assert.WithinDuration(t, expires, drained, time.Second)
+}
+
+func Test_DrainOthersEntry(t *testing.T) {
+	t.Setenv("POMAPPER_REGION", "")
+	t.Setenv("AWS_REGION", "")
+	backend := NewMemoryBackend()
+	assert.NoError(t, NewRegistry(backend).RegisterAll([]*Service{{Name: "serviceA", Port: 1, Hostname: "host2"}}))
+
+	// the entry keeps its fields, region included, and stays the other's
+	t.Setenv("POMAPPER_REGION", "us-west-2")
+	r := NewRegistry(backend)
+	assert.NoError(t, r.Drain("serviceA", 1))
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 1) {
+		assert.True(t, services[0].Draining)
+		assert.Equal(t, "host2", services[0].Hostname)
+		assert.Equal(t, "", services[0].Region)
+	}
+	_, owned := r.ownedAt(RegistryPath + "/serviceA/tcp:1")
+	assert.False(t, owned)
+}
+
+func Test_DrainingRoundTrip(t *testing.T) {
+	svc := &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Draining: true, SchemaVersion: 1}
+	bytes, err := svc.Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name":"serviceA","port":1,"protocol":"tcp","draining":true,"schema":1}`, string(bytes))
+
+	decoded, err := UnmarshalService(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, svc, decoded)
+}
+
+func Test_DrainKeepAlive(t *testing.T) {
+	defer fastRefresh()()
+	r := NewInMemoryRegistry()
+	defer r.Close()
+
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	events, err := r.Watch(watchCtx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, r.RegisterWithKeepAlive(context.Background(), "serviceA", 1, time.Second))
+	assert.NoError(t, r.Drain("serviceA", 1))
+
+	// refreshes after the drain keep the flag
+	for refreshes := 0; refreshes < 5; {
+		select {
+		case event := <-events:
+			if event.Type == Modified && event.Service.Draining {
+				refreshes++
+			}
+		case <-time.After(time.Second):
+			t.Fatal("keepalive stopped refreshing")
+		}
+	}
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 1) {
+		assert.True(t, services[0].Draining)
+	}
+}
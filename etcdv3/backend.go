@@ -0,0 +1,375 @@
+// Package etcdv3 adapts etcd's v3 API to a portmapper.Backend, for clusters
+// that no longer serve the v2 API:
+//
+//	c, err := clientv3.New(clientv3.Config{Endpoints: []string{"127.0.0.1:2379"}})
+//	...
+//	r := portmapper.NewRegistry(etcdv3.New(c))
+//
+// The v3 keyspace is flat, so the registry's directories are implied by the
+// keys below them, which are stored as the registry names them. TTLs are
+// leases, one per key. v3 and v2 keep separate keyspaces, so a registry on
+// this backend doesn't see services registered through the v2 API.
+package etcdv3
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/context"
+
+	portmapper "github.com/opsee/pomapper"
+)
+
+// Client is the part of the etcd v3 client the backend uses. *clientv3.Client
+// satisfies it.
+type Client interface {
+	Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error)
+	Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error)
+	KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error)
+	Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error)
+	TimeToLive(ctx context.Context, id clientv3.LeaseID, opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error)
+	Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan
+}
+
+// Backend is a portmapper.Backend over etcd's v3 API.
+type Backend struct {
+	c Client
+}
+
+var _ portmapper.Backend = (*Backend)(nil)
+
+// New returns a Backend storing keys through c.
+func New(c Client) *Backend {
+	return &Backend{c: c}
+}
+
+// dirKey returns the prefix of every key below key.
+func dirKey(key string) string {
+	return strings.TrimRight(key, "/") + "/"
+}
+
+func notFound(key string, rev int64) error {
+	return client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key, Index: uint64(rev)}
+}
+
+func node(kv *mvccpb.KeyValue) *client.Node {
+	return &client.Node{
+		Key:           string(kv.Key),
+		Value:         string(kv.Value),
+		CreatedIndex:  uint64(kv.CreateRevision),
+		ModifiedIndex: uint64(kv.ModRevision),
+	}
+}
+
+// Get returns the value at key or, if key is a directory, the entries below
+// it as a tree of nodes. A single key with a lease gets the lease's
+// remaining TTL.
+func (b *Backend) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	resp, err := b.c.Do(ctx, clientv3.OpGet(key))
+	if err != nil {
+		return nil, err
+	}
+	if get := resp.Get(); len(get.Kvs) > 0 {
+		n := node(get.Kvs[0])
+		if lease := clientv3.LeaseID(get.Kvs[0].Lease); lease != clientv3.NoLease {
+			ttl, err := b.c.TimeToLive(ctx, lease)
+			if err != nil {
+				return nil, err
+			}
+			if ttl.TTL > 0 {
+				n.TTL = ttl.TTL
+				expires := time.Now().Add(time.Duration(ttl.TTL) * time.Second)
+				n.Expiration = &expires
+			}
+		}
+		return &client.Response{Action: "get", Node: n, Index: uint64(get.Header.Revision)}, nil
+	}
+
+	resp, err = b.c.Do(ctx, clientv3.OpGet(dirKey(key), clientv3.WithPrefix()))
+	if err != nil {
+		return nil, err
+	}
+	get := resp.Get()
+	if len(get.Kvs) == 0 {
+		return nil, notFound(key, get.Header.Revision)
+	}
+
+	root := tree(key, get.Kvs, opts != nil && opts.Recursive)
+	return &client.Response{Action: "get", Node: root, Index: uint64(get.Header.Revision)}, nil
+}
+
+// tree arranges kvs below key into directory nodes. Unless recursive, only
+// key's immediate children are listed, and child directories are empty.
+func tree(key string, kvs []*mvccpb.KeyValue, recursive bool) *client.Node {
+	sort.Slice(kvs, func(i, j int) bool { return string(kvs[i].Key) < string(kvs[j].Key) })
+
+	key = strings.TrimRight(key, "/")
+	root := &client.Node{Key: key, Dir: true}
+	dirs := map[string]*client.Node{key: root}
+	dir := func(parent *client.Node, k string) *client.Node {
+		d, ok := dirs[k]
+		if !ok {
+			d = &client.Node{Key: k, Dir: true}
+			dirs[k] = d
+			parent.Nodes = append(parent.Nodes, d)
+		}
+		return d
+	}
+
+	for _, kv := range kvs {
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), key+"/"), "/")
+		if !recursive && len(parts) > 1 {
+			dir(root, key+"/"+parts[0])
+			continue
+		}
+
+		parent := root
+		for i := range parts[:len(parts)-1] {
+			parent = dir(parent, key+"/"+strings.Join(parts[:i+1], "/"))
+		}
+		parent.Nodes = append(parent.Nodes, node(kv))
+	}
+
+	return root
+}
+
+// Set writes value at key, under a lease if opts.TTL is set. A key already
+// under a lease of the same TTL, such as a keepalive's, keeps it renewed;
+// otherwise a new lease is granted, and the key's old one revoked once the
+// write succeeds. PrevNoExist and PrevExist are honoured with a transaction,
+// failing as etcd v2 would.
+func (b *Backend) Set(ctx context.Context, key, value string, opts *client.SetOptions) (resp *client.Response, err error) {
+	if opts == nil {
+		opts = &client.SetOptions{}
+	}
+
+	var putOpts []clientv3.OpOption
+	if opts.TTL > 0 {
+		// leases count whole seconds, so round up rather than expire early
+		secs := int64((opts.TTL + time.Second - 1) / time.Second)
+		prev, lease, granted, err := b.leaseFor(ctx, key, secs)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			// a lease nothing ended up using would only linger until it
+			// expired, and the old one has no key left once replaced
+			switch {
+			case resp == nil && granted:
+				b.c.Revoke(context.Background(), lease)
+			case resp != nil && granted && prev != clientv3.NoLease:
+				b.c.Revoke(context.Background(), prev)
+			}
+		}()
+		putOpts = append(putOpts, clientv3.WithLease(lease))
+	}
+	put := clientv3.OpPut(key, value, putOpts...)
+
+	var rev int64
+	switch opts.PrevExist {
+	case client.PrevNoExist, client.PrevExist:
+		cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+		if opts.PrevExist == client.PrevExist {
+			cmp = clientv3.Compare(clientv3.CreateRevision(key), ">", 0)
+		}
+		resp, err := b.c.Do(ctx, clientv3.OpTxn([]clientv3.Cmp{cmp}, []clientv3.Op{put}, nil))
+		if err != nil {
+			return nil, err
+		}
+		txn := resp.Txn()
+		if !txn.Succeeded {
+			if opts.PrevExist == client.PrevExist {
+				return nil, notFound(key, txn.Header.Revision)
+			}
+			return nil, client.Error{Code: client.ErrorCodeNodeExist, Message: "Key already exists", Cause: key, Index: uint64(txn.Header.Revision)}
+		}
+		rev = txn.Header.Revision
+	default:
+		resp, err := b.c.Do(ctx, put)
+		if err != nil {
+			return nil, err
+		}
+		rev = resp.Put().Header.Revision
+	}
+
+	return &client.Response{
+		Action: "set",
+		Node:   &client.Node{Key: key, Value: value, ModifiedIndex: uint64(rev)},
+		Index:  uint64(rev),
+	}, nil
+}
+
+// leaseFor returns the lease key is under, if any, and a lease of secs
+// seconds to write it with: the same one renewed, if it was granted for as
+// long and is still alive, or else a new one, reporting whether it is new.
+func (b *Backend) leaseFor(ctx context.Context, key string, secs int64) (prev, lease clientv3.LeaseID, granted bool, err error) {
+	resp, err := b.c.Do(ctx, clientv3.OpGet(key))
+	if err != nil {
+		return clientv3.NoLease, clientv3.NoLease, false, err
+	}
+	if get := resp.Get(); len(get.Kvs) > 0 {
+		prev = clientv3.LeaseID(get.Kvs[0].Lease)
+	}
+	if prev != clientv3.NoLease {
+		if renewed, err := b.c.KeepAliveOnce(ctx, prev); err == nil && renewed.TTL == secs {
+			return prev, prev, false, nil
+		}
+	}
+
+	grant, err := b.c.Grant(ctx, secs)
+	if err != nil {
+		return prev, clientv3.NoLease, false, err
+	}
+	return prev, grant.ID, true, nil
+}
+
+// Delete removes key, or everything below it when opts.Recursive is set. A
+// missing key is an error, as it is with etcd v2.
+func (b *Backend) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	resp, err := b.c.Do(ctx, clientv3.OpDelete(key, clientv3.WithPrevKV()))
+	if err != nil {
+		return nil, err
+	}
+	del := resp.Del()
+	if del.Deleted > 0 {
+		rev := del.Header.Revision
+		deleted := &client.Response{Action: "delete", Node: &client.Node{Key: key, ModifiedIndex: uint64(rev)}, Index: uint64(rev)}
+		if len(del.PrevKvs) > 0 {
+			deleted.PrevNode = node(del.PrevKvs[0])
+		}
+		return deleted, nil
+	}
+
+	if opts == nil || !opts.Recursive {
+		// say whether key is missing or a directory, as v2 would
+		resp, err := b.c.Do(ctx, clientv3.OpGet(dirKey(key), clientv3.WithPrefix(), clientv3.WithCountOnly()))
+		if err != nil {
+			return nil, err
+		}
+		if get := resp.Get(); get.Count > 0 {
+			return nil, client.Error{Code: client.ErrorCodeNotFile, Message: "Not a file", Cause: key, Index: uint64(get.Header.Revision)}
+		}
+		return nil, notFound(key, del.Header.Revision)
+	}
+
+	resp, err = b.c.Do(ctx, clientv3.OpDelete(dirKey(key), clientv3.WithPrefix()))
+	if err != nil {
+		return nil, err
+	}
+	del = resp.Del()
+	if del.Deleted == 0 {
+		return nil, notFound(key, del.Header.Revision)
+	}
+
+	rev := del.Header.Revision
+	return &client.Response{Action: "delete", Node: &client.Node{Key: key, Dir: true, ModifiedIndex: uint64(rev)}, Index: uint64(rev)}, nil
+}
+
+// ErrWatchClosed is returned by a watcher whose v3 watch ended for a reason
+// other than its context, such as the client being closed.
+var ErrWatchClosed = errors.New("etcd v3 watch closed")
+
+// Watcher returns a watcher for key, or for every key below it if
+// opts.Recursive is set, starting after opts.AfterIndex if that is set. The
+// v3 watch starts on the first Next and lasts as long as that call's
+// context, so a watcher should be used with a single context.
+func (b *Backend) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	if opts == nil {
+		opts = &client.WatcherOptions{}
+	}
+
+	w := &watcher{c: b.c, key: key, watchOpts: []clientv3.OpOption{clientv3.WithPrevKV()}}
+	if opts.Recursive {
+		w.key = dirKey(key)
+		w.watchOpts = append(w.watchOpts, clientv3.WithPrefix())
+	}
+	if opts.AfterIndex > 0 {
+		w.watchOpts = append(w.watchOpts, clientv3.WithRev(int64(opts.AfterIndex)+1))
+	}
+	return w
+}
+
+type watcher struct {
+	c         Client
+	key       string
+	watchOpts []clientv3.OpOption
+	events    clientv3.WatchChan
+	pending   []*client.Response
+}
+
+// Next blocks until a watched key changes and returns the change. Changes
+// that arrive together are returned one per call, in order. If etcd has
+// compacted away the revision the watch would start from, Next fails with
+// ErrorCodeEventIndexCleared and the current revision, as v2 does.
+func (w *watcher) Next(ctx context.Context) (*client.Response, error) {
+	if w.events == nil {
+		w.events = w.c.Watch(clientv3.WithRequireLeader(ctx), w.key, w.watchOpts...)
+	}
+
+	for len(w.pending) == 0 {
+		var (
+			resp clientv3.WatchResponse
+			ok   bool
+		)
+		select {
+		case resp, ok = <-w.events:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !ok {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, ErrWatchClosed
+		}
+
+		if resp.CompactRevision > 0 {
+			return nil, client.Error{
+				Code:    client.ErrorCodeEventIndexCleared,
+				Message: "The event in requested index is outdated and cleared",
+				Cause:   w.key,
+				Index:   uint64(resp.Header.Revision),
+			}
+		}
+		if err := resp.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, ev := range resp.Events {
+			w.pending = append(w.pending, change(ev))
+		}
+	}
+
+	resp := w.pending[0]
+	w.pending = w.pending[1:]
+	return resp, nil
+}
+
+// change returns the v2 style response for a v3 event.
+func change(ev *clientv3.Event) *client.Response {
+	resp := &client.Response{Index: uint64(ev.Kv.ModRevision)}
+	if ev.PrevKv != nil {
+		resp.PrevNode = node(ev.PrevKv)
+	}
+
+	switch ev.Type {
+	case clientv3.EventTypeDelete:
+		// v3 doesn't say whether a lease ran out or the key was deleted
+		resp.Action = "delete"
+		resp.Node = &client.Node{Key: string(ev.Kv.Key), ModifiedIndex: uint64(ev.Kv.ModRevision)}
+	default:
+		resp.Action = "set"
+		if ev.IsCreate() {
+			resp.Action = "create"
+			resp.PrevNode = nil
+		}
+		resp.Node = node(ev.Kv)
+	}
+
+	return resp
+}
@@ -0,0 +1,413 @@
+package etcdv3
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/context"
+
+	portmapper "github.com/opsee/pomapper"
+)
+
+// fakeClient is an in-memory etcd v3 store that keeps every event, so
+// watches can start from any revision that hasn't been compacted.
+type fakeClient struct {
+	mu        sync.Mutex
+	rev       int64
+	kvs       map[string]*mvccpb.KeyValue
+	leases    map[clientv3.LeaseID]int64
+	granted   int
+	events    []*clientv3.Event
+	compacted int64
+	changed   chan struct{}
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		rev:     1,
+		kvs:     map[string]*mvccpb.KeyValue{},
+		leases:  map[clientv3.LeaseID]int64{},
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *fakeClient) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: f.rev}
+}
+
+// record appends an event and wakes watches. The caller holds mu.
+func (f *fakeClient) record(typ mvccpb.Event_EventType, kv, prev *mvccpb.KeyValue) {
+	f.events = append(f.events, &clientv3.Event{Type: typ, Kv: kv, PrevKv: prev})
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// match returns the keys op ranges over, in order.
+func (f *fakeClient) match(op clientv3.Op) []string {
+	key, end := string(op.KeyBytes()), string(op.RangeBytes())
+	var keys []string
+	for k := range f.kvs {
+		if k == key || (end != "" && k >= key && k < end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// leaseOf digs the lease out of a put, which Op doesn't expose.
+func leaseOf(op clientv3.Op) int64 {
+	return reflect.ValueOf(op).FieldByName("leaseID").Int()
+}
+
+func (f *fakeClient) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.do(op), nil
+}
+
+func (f *fakeClient) do(op clientv3.Op) clientv3.OpResponse {
+	switch {
+	case op.IsGet():
+		resp := &clientv3.GetResponse{Header: f.header()}
+		for _, k := range f.match(op) {
+			resp.Count++
+			if !op.IsCountOnly() {
+				resp.Kvs = append(resp.Kvs, f.kvs[k])
+			}
+		}
+		return resp.OpResponse()
+	case op.IsPut():
+		f.rev++
+		key := string(op.KeyBytes())
+		prev := f.kvs[key]
+		kv := &mvccpb.KeyValue{Key: op.KeyBytes(), Value: op.ValueBytes(), CreateRevision: f.rev, ModRevision: f.rev, Lease: leaseOf(op)}
+		if prev != nil {
+			kv.CreateRevision = prev.CreateRevision
+		}
+		f.kvs[key] = kv
+		f.record(mvccpb.PUT, kv, prev)
+		return (&clientv3.PutResponse{Header: f.header()}).OpResponse()
+	case op.IsDelete():
+		resp := &clientv3.DeleteResponse{}
+		keys := f.match(op)
+		if len(keys) > 0 {
+			f.rev++
+		}
+		for _, k := range keys {
+			prev := f.kvs[k]
+			delete(f.kvs, k)
+			resp.Deleted++
+			resp.PrevKvs = append(resp.PrevKvs, prev)
+			f.record(mvccpb.DELETE, &mvccpb.KeyValue{Key: prev.Key, ModRevision: f.rev}, prev)
+		}
+		resp.Header = f.header()
+		return resp.OpResponse()
+	default:
+		cmps, thens, elses := op.Txn()
+		resp := &clientv3.TxnResponse{Succeeded: true}
+		for _, cmp := range cmps {
+			var created int64
+			if kv, ok := f.kvs[string(cmp.Key)]; ok {
+				created = kv.CreateRevision
+			}
+			want := cmp.TargetUnion.(*pb.Compare_CreateRevision).CreateRevision
+			switch cmp.Result {
+			case pb.Compare_EQUAL:
+				resp.Succeeded = resp.Succeeded && created == want
+			case pb.Compare_GREATER:
+				resp.Succeeded = resp.Succeeded && created > want
+			}
+		}
+		ops := thens
+		if !resp.Succeeded {
+			ops = elses
+		}
+		for _, op := range ops {
+			f.do(op)
+		}
+		resp.Header = f.header()
+		return resp.OpResponse()
+	}
+}
+
+func (f *fakeClient) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.granted++
+	id := clientv3.LeaseID(f.granted)
+	f.leases[id] = ttl
+	return &clientv3.LeaseGrantResponse{ID: id, TTL: ttl}, nil
+}
+
+func (f *fakeClient) TimeToLive(ctx context.Context, id clientv3.LeaseID, opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ttl, ok := f.leases[id]
+	if !ok {
+		ttl = -1
+	}
+	return &clientv3.LeaseTimeToLiveResponse{ID: id, TTL: ttl, GrantedTTL: ttl}, nil
+}
+
+func (f *fakeClient) KeepAliveOnce(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseKeepAliveResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ttl, ok := f.leases[id]
+	if !ok {
+		return nil, errors.New("requested lease not found")
+	}
+	return &clientv3.LeaseKeepAliveResponse{ID: id, TTL: ttl}, nil
+}
+
+func (f *fakeClient) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	f.expire(id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+// expire ends lease id, deleting its keys.
+func (f *fakeClient) expire(id clientv3.LeaseID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.leases, id)
+	for k, kv := range f.kvs {
+		if clientv3.LeaseID(kv.Lease) == id {
+			f.do(clientv3.OpDelete(k))
+		}
+	}
+}
+
+// Watch replays the events in the watched range from the requested revision
+// on, then follows new ones until ctx is done.
+func (f *fakeClient) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	op := clientv3.OpGet(key, opts...)
+	ch := make(chan clientv3.WatchResponse)
+
+	go func() {
+		defer close(ch)
+
+		f.mu.Lock()
+		from := op.Rev()
+		if from == 0 {
+			from = f.rev + 1
+		}
+		if from <= f.compacted {
+			resp := clientv3.WatchResponse{Header: *f.header(), CompactRevision: f.compacted, Canceled: true}
+			f.mu.Unlock()
+			select {
+			case ch <- resp:
+			case <-ctx.Done():
+			}
+			return
+		}
+		f.mu.Unlock()
+
+		sent := 0
+		for {
+			f.mu.Lock()
+			var batch []*clientv3.Event
+			for _, ev := range f.events[sent:] {
+				k := string(ev.Kv.Key)
+				inRange := k == key || (len(op.RangeBytes()) > 0 && k >= key && k < string(op.RangeBytes()))
+				if inRange && ev.Kv.ModRevision >= from {
+					batch = append(batch, ev)
+				}
+			}
+			sent = len(f.events)
+			changed := f.changed
+			header := *f.header()
+			f.mu.Unlock()
+
+			if len(batch) > 0 {
+				select {
+				case ch <- clientv3.WatchResponse{Header: header, Events: batch}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+func Test_RegistryRoundTrip(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	fake := newFakeClient()
+	r := portmapper.NewRegistry(New(fake))
+
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.NoError(t, r.RegisterWithTags("serviceA", 2, map[string]string{"env": "prod"}))
+	assert.NoError(t, r.RegisterAll([]*portmapper.Service{{Name: "serviceB", Port: 53, Protocol: portmapper.ProtocolUDP}}))
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 3) {
+		assert.Equal(t, "serviceA:1/tcp@host1", services[0].String())
+		assert.Equal(t, map[string]string{"env": "prod"}, services[1].Tags)
+		assert.Equal(t, "serviceB:53/udp@host1", services[2].String())
+	}
+	n, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// create-only and update-only writes go through transactions
+	assert.ErrorIs(t, r.RegisterExclusive("serviceA", 1), portmapper.ErrAlreadyRegistered)
+	assert.NoError(t, r.RegisterExclusive("serviceA", 3))
+	assert.Error(t, r.Refresh(&portmapper.Service{Name: "serviceC", Port: 4}))
+	assert.NoError(t, r.Refresh(&portmapper.Service{Name: "serviceA", Port: 3, Hostname: "host2"}))
+
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	removed, err := r.UnregisterService("serviceA")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+
+	services, err = r.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 1) {
+		assert.Equal(t, "serviceB", services[0].Name)
+	}
+	assert.NoError(t, r.UnregisterInstance(services[0]))
+
+	services, err = r.Services()
+	assert.NoError(t, err)
+	assert.Empty(t, services)
+}
+
+func Test_TTLIsALease(t *testing.T) {
+	fake := newFakeClient()
+	b := New(fake)
+	r := portmapper.NewRegistry(b)
+
+	assert.NoError(t, r.RegisterTTL("serviceA", 1, 1500*time.Millisecond))
+	assert.Equal(t, map[clientv3.LeaseID]int64{1: 2}, fake.leases)
+
+	resp, err := b.Get(context.Background(), portmapper.Key("serviceA", 1), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), resp.Node.TTL)
+
+	// draining keeps the remaining TTL, and the lease with it
+	assert.NoError(t, r.Drain("serviceA", 1))
+	assert.Equal(t, map[clientv3.LeaseID]int64{1: 2}, fake.leases)
+
+	fake.expire(1)
+	registered, err := r.IsRegistered("serviceA", 1)
+	assert.NoError(t, err)
+	assert.False(t, registered)
+}
+
+func Test_LeaseReuse(t *testing.T) {
+	fake := newFakeClient()
+	b := New(fake)
+	ctx := context.Background()
+	key := portmapper.Key("serviceA", 1)
+
+	// refreshing with the same TTL renews the lease the key has
+	for i := 0; i < 3; i++ {
+		_, err := b.Set(ctx, key, "1", &client.SetOptions{TTL: time.Minute})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, map[clientv3.LeaseID]int64{1: 60}, fake.leases)
+
+	// a new TTL gets a new lease, and the old one goes
+	_, err := b.Set(ctx, key, "1", &client.SetOptions{TTL: 2 * time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, map[clientv3.LeaseID]int64{2: 120}, fake.leases)
+
+	// a lease granted for a write that fails is revoked
+	_, err = b.Set(ctx, key, "1", &client.SetOptions{TTL: time.Minute, PrevExist: client.PrevNoExist})
+	assert.Equal(t, client.ErrorCodeNodeExist, err.(client.Error).Code)
+	assert.Equal(t, map[clientv3.LeaseID]int64{2: 120}, fake.leases)
+	resp, err := b.Get(ctx, key, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", resp.Node.Value)
+}
+
+func Test_Watch(t *testing.T) {
+	fake := newFakeClient()
+	r := portmapper.NewRegistry(New(fake))
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := r.Watch(ctx)
+	assert.NoError(t, err)
+
+	// give the watch time to start before changing anything
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, r.RegisterWithHostname("serviceA", 1, "host1"))
+	assert.NoError(t, r.RegisterWithHostname("serviceA", 1, "host2"))
+	assert.NoError(t, r.Unregister("serviceA", 1))
+
+	expected := []struct {
+		typ      portmapper.EventType
+		hostname string
+	}{
+		{portmapper.Added, "host1"},
+		{portmapper.Modified, "host2"},
+		{portmapper.Deleted, "host2"},
+	}
+	for _, want := range expected {
+		select {
+		case got := <-events:
+			assert.Equal(t, want.typ, got.Type)
+			assert.Equal(t, want.hostname, got.Service.Hostname)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want.typ)
+		}
+	}
+}
+
+func Test_WatcherCompacted(t *testing.T) {
+	fake := newFakeClient()
+	b := New(fake)
+	_, err := b.Set(context.Background(), "/a/b", "1", nil)
+	assert.NoError(t, err)
+	fake.compacted = fake.rev
+
+	w := b.Watcher("/a", &client.WatcherOptions{Recursive: true, AfterIndex: 1})
+	_, err = w.Next(context.Background())
+	if cerr, ok := err.(client.Error); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, client.ErrorCodeEventIndexCleared, cerr.Code)
+		assert.Equal(t, uint64(fake.rev), cerr.Index)
+	}
+}
+
+func Test_MissingKeys(t *testing.T) {
+	b := New(newFakeClient())
+	ctx := context.Background()
+
+	_, err := b.Get(ctx, "/a", nil)
+	assert.Equal(t, client.ErrorCodeKeyNotFound, err.(client.Error).Code)
+	_, err = b.Delete(ctx, "/a", nil)
+	assert.Equal(t, client.ErrorCodeKeyNotFound, err.(client.Error).Code)
+
+	_, err = b.Set(ctx, "/a/b", "1", nil)
+	assert.NoError(t, err)
+	_, err = b.Delete(ctx, "/a", nil)
+	assert.Equal(t, client.ErrorCodeNotFile, err.(client.Error).Code)
+	_, err = b.Delete(ctx, "/a", &client.DeleteOptions{Recursive: true})
+	assert.NoError(t, err)
+	_, err = b.Get(ctx, "/a/b", nil)
+	assert.Equal(t, client.ErrorCodeKeyNotFound, err.(client.Error).Code)
+}
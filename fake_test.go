@@ -0,0 +1,103 @@
+package portmapper
+
+import (
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// fakeKeysAPI is a client.KeysAPI whose behaviour is supplied per test. Any
+// method without a stub panics through the nil embedded interface.
+type fakeKeysAPI struct {
+	client.KeysAPI
+
+	get     func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error)
+	set     func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error)
+	delete  func(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error)
+	watcher func(key string, opts *client.WatcherOptions) client.Watcher
+
+	gets    int
+	sets    int
+	deletes int
+}
+
+func (f *fakeKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	f.gets++
+	return f.get(ctx, key, opts)
+}
+
+func (f *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	f.sets++
+	return f.set(ctx, key, value, opts)
+}
+
+func (f *fakeKeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	f.deletes++
+	return f.delete(ctx, key, opts)
+}
+
+func (f *fakeKeysAPI) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	return f.watcher(key, opts)
+}
+
+// fakeWatcher replays responses in order and then fails with err or, if err
+// is nil, blocks until the context passed to Next is done.
+type fakeWatcher struct {
+	responses []*client.Response
+	err       error
+}
+
+func (w *fakeWatcher) Next(ctx context.Context) (*client.Response, error) {
+	if len(w.responses) == 0 {
+		if w.err != nil {
+			return nil, w.err
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	resp := w.responses[0]
+	w.responses = w.responses[1:]
+	return resp, nil
+}
+
+// serviceNode returns an etcd node holding svc.
+func serviceNode(svc *Service) *client.Node {
+	value, _ := svc.Marshal()
+	return &client.Node{Key: svc.path(), Value: string(value)}
+}
+
+// registryGet returns a Get stub answering with services laid out the way a
+// recursive etcd get would: a directory per name holding protocol:port keys.
+func registryGet(services ...*Service) func(context.Context, string, *client.GetOptions) (*client.Response, error) {
+	return func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		root := &client.Node{Key: key, Dir: true}
+		dirs := map[string]*client.Node{}
+		for _, svc := range services {
+			dir, ok := dirs[svc.Name]
+			if !ok {
+				dir = &client.Node{Key: key + "/" + svc.Name, Dir: true}
+				dirs[svc.Name] = dir
+				root.Nodes = append(root.Nodes, dir)
+			}
+			dir.Nodes = append(dir.Nodes, serviceNode(svc))
+		}
+
+		return &client.Response{Action: "get", Node: root}, nil
+	}
+}
+
+// useKeysAPI makes the package functions talk to kapi until the returned
+// func is called.
+func useKeysAPI(kapi Backend) func() {
+	orig := defaultReg
+	defaultReg = NewRegistry(kapi)
+	return func() { defaultReg = orig }
+}
+
+// useConfig makes the package functions build their client from c until the
+// returned func is called.
+func useConfig(c client.Config) func() {
+	origCfg, origReg, origTLS, origDial := cfg, defaultReg, tlsConfig, dialTimeout
+	cfg, defaultReg = c, nil
+	return func() { cfg, defaultReg, tlsConfig, dialTimeout = origCfg, origReg, origTLS, origDial }
+}
@@ -0,0 +1,44 @@
+package portmapper
+
+// Hooks are callbacks a Registry runs as services are registered and
+// unregistered, e.g. to feed counts into a metrics system. Any of them may be
+// nil. Each runs in its own goroutine so a slow hook can't hold up the
+// registry, which also means hooks may run concurrently and out of order.
+type Hooks struct {
+	// OnRegister is called with each service after it is written. Keepalive
+	// refreshes of a registration don't call it again.
+	OnRegister func(*Service)
+	// OnUnregister is called with each service after it is deleted.
+	OnUnregister func(*Service)
+	// OnError is called when a register, unregister or services operation
+	// fails, with that name and the error returned to the caller.
+	OnError func(op string, err error)
+}
+
+// WithHooks makes the Registry run h's callbacks.
+func WithHooks(h Hooks) Option {
+	return func(r *Registry) {
+		r.hooks = h
+	}
+}
+
+// registered runs OnRegister with a copy of svc.
+func (h Hooks) registered(svc *Service) {
+	if h.OnRegister != nil {
+		go h.OnRegister(svc.Clone())
+	}
+}
+
+// unregistered runs OnUnregister with a copy of svc.
+func (h Hooks) unregistered(svc *Service) {
+	if h.OnUnregister != nil {
+		go h.OnUnregister(svc.Clone())
+	}
+}
+
+// failed runs OnError.
+func (h Hooks) failed(op string, err error) {
+	if h.OnError != nil {
+		go h.OnError(op, err)
+	}
+}
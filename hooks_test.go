@@ -0,0 +1,126 @@
+package portmapper
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_Hooks(t *testing.T) {
+	registered := make(chan *Service, 1)
+	unregistered := make(chan *Service, 1)
+	type failure struct {
+		op  string
+		err error
+	}
+	failed := make(chan failure, 1)
+
+	r := NewInMemoryRegistry(WithHooks(Hooks{
+		OnRegister:   func(svc *Service) { registered <- svc },
+		OnUnregister: func(svc *Service) { unregistered <- svc },
+		OnError:      func(op string, err error) { failed <- failure{op, err} },
+	}))
+
+	assert.NoError(t, r.Register("serviceA", 1))
+	select {
+	case svc := <-registered:
+		assert.Equal(t, "serviceA", svc.Name)
+		assert.Equal(t, 1, svc.Port)
+	case <-time.After(time.Second):
+		t.Fatal("OnRegister not called")
+	}
+
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	select {
+	case svc := <-unregistered:
+		assert.Equal(t, "serviceA", svc.Name)
+	case <-time.After(time.Second):
+		t.Fatal("OnUnregister not called")
+	}
+
+	err := r.Register("serviceA", 0)
+	select {
+	case f := <-failed:
+		assert.Equal(t, "register", f.op)
+		assert.Equal(t, err, f.err)
+		assert.True(t, errors.Is(f.err, ErrInvalidPort))
+	case <-time.After(time.Second):
+		t.Fatal("OnError not called")
+	}
+
+	err = r.Unregister("", 1)
+	select {
+	case f := <-failed:
+		assert.Equal(t, "unregister", f.op)
+		assert.Equal(t, err, f.err)
+	case <-time.After(time.Second):
+		t.Fatal("OnError not called")
+	}
+}
+
+func Test_HooksDontBlock(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	r := NewInMemoryRegistry(WithHooks(Hooks{OnRegister: func(*Service) { <-block }}))
+	done := make(chan error)
+	go func() { done <- r.Register("serviceA", 1) }()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Register waited for its hook")
+	}
+
+	// a registry without hooks is fine too
+	assert.NoError(t, NewInMemoryRegistry(WithHooks(Hooks{})).Register("serviceA", 1))
+}
+
+func Test_KeepAliveRefreshSkipsHooks(t *testing.T) {
+	defer fastRefresh()()
+	capture := &captureLogger{}
+	defer useLogger(capture)()
+
+	var registrations int32
+	r := NewInMemoryRegistry(WithHooks(Hooks{
+		OnRegister: func(*Service) { atomic.AddInt32(&registrations, 1) },
+	}))
+	defer r.Close()
+
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	events, err := r.Watch(watchCtx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, r.RegisterWithKeepAlive(context.Background(), "serviceA", 1, time.Second))
+	for refreshes := 0; refreshes < 3; {
+		select {
+		case event := <-events:
+			if event.Type == Modified {
+				refreshes++
+			}
+		case <-time.After(time.Second):
+			t.Fatal("keepalive did not refresh")
+		}
+	}
+
+	// only the first write counts as a registration
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&registrations))
+
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	levels := map[string]int{}
+	for _, entry := range capture.entries {
+		if entry.msg == "Successfully registered service with etcd" {
+			levels[entry.level]++
+		}
+	}
+	assert.Equal(t, 1, levels["info"])
+	assert.True(t, levels["debug"] >= 3, "%v", levels)
+}
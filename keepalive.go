@@ -0,0 +1,224 @@
+package portmapper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// RegisterWithKeepAlive registers a service with a TTL and keeps the key alive
+// from a background goroutine, re-setting it every ttl/3 until ctx is done.
+// The key is then deleted. If the process dies instead, the key expires after
+// ttl. Every service a registry keeps alive with the same ttl shares one
+// goroutine, so a single heartbeat covers them all. ttl must be at least a
+// second.
+func (r *Registry) RegisterWithKeepAlive(ctx context.Context, name string, port int, ttl time.Duration) error {
+	if err := checkTTL(ttl); err != nil {
+		return err
+	}
+
+	svc := &Service{Name: name, Port: port, Hostname: localHostname()}
+	opts := &client.SetOptions{TTL: ttl}
+
+	if err := r.register(ctx, svc, opts); err != nil {
+		return err
+	}
+
+	r.kaMu.Lock()
+	hb := r.heartbeats[ttl]
+	if hb == nil {
+		hb = &heartbeat{opts: opts, services: map[*Service]bool{}, wake: make(chan struct{}, 1)}
+		if !r.spawn(func() { r.keepAlive(hb) }) {
+			r.kaMu.Unlock()
+			r.unregister(context.Background(), svc)
+			return ErrClosed
+		}
+		if r.heartbeats == nil {
+			r.heartbeats = map[time.Duration]*heartbeat{}
+		}
+		r.heartbeats[ttl] = hb
+	}
+	hb.services[svc] = true
+	r.kaMu.Unlock()
+
+	// hand svc back to the heartbeat once ctx is done, so that its delete
+	// can't race a refresh
+	ctx, cancel := r.bind(ctx)
+	started := r.spawn(func() {
+		defer cancel()
+		<-ctx.Done()
+
+		r.kaMu.Lock()
+		if hb.services[svc] {
+			delete(hb.services, svc)
+			hb.stopped = append(hb.stopped, svc)
+		}
+		r.kaMu.Unlock()
+
+		select {
+		case hb.wake <- struct{}{}:
+		default:
+		}
+	})
+	if !started {
+		// Close has begun and the heartbeat is unregistering everything
+		cancel()
+		return ErrClosed
+	}
+	return nil
+}
+
+// heartbeat is the set of services a registry keeps alive with one TTL. Its
+// fields are guarded by the registry's kaMu.
+type heartbeat struct {
+	opts     *client.SetOptions
+	services map[*Service]bool
+	// stopped holds services whose ctx is done, for keepAlive to delete
+	stopped []*Service
+	wake    chan struct{}
+}
+
+// refreshInterval returns how often keys with ttl are refreshed, replaceable
+// in tests.
+var refreshInterval = func(ttl time.Duration) time.Duration {
+	return ttl / 3
+}
+
+// keepAlive refreshes hb's services every TTL/3 and unregisters each one
+// once its ctx is done. It returns when no services are left or the
+// registry is closed, unregistering whatever remains.
+func (r *Registry) keepAlive(hb *heartbeat) {
+	ticker := time.NewTicker(refreshInterval(hb.opts.TTL))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			r.kaMu.Lock()
+			delete(r.heartbeats, hb.opts.TTL)
+			remaining := hb.stopped
+			for svc := range hb.services {
+				remaining = append(remaining, svc)
+			}
+			hb.services, hb.stopped = nil, nil
+			r.kaMu.Unlock()
+
+			r.stopKeepAlive(remaining)
+			return
+		case <-hb.wake:
+			r.kaMu.Lock()
+			stopped := hb.stopped
+			hb.stopped = nil
+			r.kaMu.Unlock()
+
+			r.stopKeepAlive(stopped)
+
+			r.kaMu.Lock()
+			if len(hb.services) == 0 && len(hb.stopped) == 0 {
+				delete(r.heartbeats, hb.opts.TTL)
+				r.kaMu.Unlock()
+				return
+			}
+			r.kaMu.Unlock()
+		case <-ticker.C:
+			r.kaMu.Lock()
+			services := make([]*Service, 0, len(hb.services))
+			for svc := range hb.services {
+				// copied, since Drain may change them
+				services = append(services, svc.Clone())
+			}
+			r.kaMu.Unlock()
+
+			for _, svc := range services {
+				if err := r.write(r.ctx, svc, hb.opts, true); err != nil && r.ctx.Err() == nil {
+					logger().Warn("Service keepalive refresh failed. Retrying at next interval", Fields{
+						"action":  "KeepAlive",
+						"service": svc.Name,
+						"port":    svc.Port,
+						"errstr":  err.Error(),
+					})
+				}
+			}
+		}
+	}
+}
+
+// drainKeepAlive sets Draining on any kept alive service stored at path, so
+// that its refreshes keep the flag, and reports whether there was one.
+func (r *Registry) drainKeepAlive(path string, draining bool) bool {
+	r.kaMu.Lock()
+	defer r.kaMu.Unlock()
+
+	found := false
+	for _, hb := range r.heartbeats {
+		for svc := range hb.services {
+			if r.path(svc) == path {
+				svc.Draining = draining
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+// stopKeepAlive unregisters services whose keepalive has ended.
+func (r *Registry) stopKeepAlive(services []*Service) {
+	for _, svc := range services {
+		// the registry's ctx may be done, so the delete needs its own
+		if err := r.unregister(context.Background(), svc); err != nil {
+			logger().Error("Failed to unregister service after keepalive stopped.", Fields{
+				"action":  "KeepAlive",
+				"service": svc.Name,
+				"port":    svc.Port,
+				"errstr":  err.Error(),
+			})
+		}
+	}
+}
+
+// RegisterAndAutoUnregister registers a service and returns a cleanup func
+// that unregisters it. Cleanup also runs by itself once ctx is done or the
+// registry is closed, so a ctx from signal.NotifyContext unregisters on
+// SIGTERM. Calling cleanup more than once is harmless.
+func (r *Registry) RegisterAndAutoUnregister(ctx context.Context, name string, port int) (func(), error) {
+	svc := &Service{Name: name, Port: port, Hostname: localHostname()}
+	if err := r.register(ctx, svc, nil); err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	var once sync.Once
+	cleanup := func() {
+		once.Do(func() {
+			close(stop)
+			// ctx may be the reason we're here, so the delete needs its own
+			if err := r.unregister(context.Background(), svc); err != nil {
+				logger().Error("Failed to unregister service on cleanup.", Fields{
+					"action":  "AutoUnregister",
+					"service": name,
+					"port":    port,
+					"errstr":  err.Error(),
+				})
+			}
+		})
+	}
+
+	ctx, cancel := r.bind(ctx)
+	started := r.spawn(func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
+			cleanup()
+		case <-stop:
+		}
+	})
+	if !started {
+		cancel()
+		cleanup()
+		return nil, ErrClosed
+	}
+
+	return cleanup, nil
+}
@@ -0,0 +1,199 @@
+package portmapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// fastRefresh makes keepalives refresh every 10ms, whatever their TTL,
+// until the returned func is called.
+func fastRefresh() func() {
+	orig := refreshInterval
+	refreshInterval = func(time.Duration) time.Duration { return 10 * time.Millisecond }
+	return func() { refreshInterval = orig }
+}
+
+func Test_RegisterWithKeepAlive(t *testing.T) {
+	defer fastRefresh()()
+	refreshed := make(chan *client.SetOptions, 16)
+	deleted := make(chan string, 1)
+	kapi := &fakeKeysAPI{
+		set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+			select {
+			case refreshed <- opts:
+			default:
+			}
+			return &client.Response{}, nil
+		},
+		delete: func(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+			deleted <- key
+			return &client.Response{}, nil
+		},
+	}
+	r := NewRegistry(kapi)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, r.RegisterWithKeepAlive(ctx, "serviceA", 1, time.Second))
+
+	// the initial registration plus at least two refreshes
+	for i := 0; i < 3; i++ {
+		select {
+		case opts := <-refreshed:
+			assert.Equal(t, time.Second, opts.TTL)
+		case <-time.After(time.Second):
+			t.Fatalf("only saw %d of 3 sets", i)
+		}
+	}
+
+	cancel()
+	select {
+	case key := <-deleted:
+		assert.Equal(t, RegistryPath+"/serviceA/tcp:1", key)
+	case <-time.After(time.Second):
+		t.Fatal("key was not deleted after cancel")
+	}
+}
+
+func Test_RegisterWithKeepAliveSharesHeartbeat(t *testing.T) {
+	defer fastRefresh()()
+	r := NewInMemoryRegistry()
+	defer r.Close()
+
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	events, err := r.Watch(watchCtx)
+	assert.NoError(t, err)
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	assert.NoError(t, r.RegisterWithKeepAlive(ctxA, "serviceA", 1, time.Second))
+	assert.NoError(t, r.RegisterWithKeepAlive(ctxB, "serviceB", 2, time.Second))
+
+	r.kaMu.Lock()
+	assert.Equal(t, 1, len(r.heartbeats))
+	r.kaMu.Unlock()
+
+	next := func() ServiceEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+		return ServiceEvent{}
+	}
+
+	// both are refreshed by the one heartbeat
+	refreshed := map[string]int{}
+	for refreshed["serviceA"] < 2 || refreshed["serviceB"] < 2 {
+		if event := next(); event.Type == Modified {
+			refreshed[event.Service.Name]++
+		}
+	}
+
+	// stopping one leaves the other alive
+	cancelA()
+	for {
+		if event := next(); event.Type == Deleted {
+			assert.Equal(t, "serviceA", event.Service.Name)
+			break
+		}
+	}
+	for {
+		if event := next(); event.Type == Modified {
+			assert.Equal(t, "serviceB", event.Service.Name)
+			break
+		}
+	}
+
+	// and the heartbeat goes once nothing is left on it
+	cancelB()
+	for {
+		if event := next(); event.Type == Deleted {
+			assert.Equal(t, "serviceB", event.Service.Name)
+			break
+		}
+	}
+	assert.Eventually(t, func() bool {
+		r.kaMu.Lock()
+		defer r.kaMu.Unlock()
+		return len(r.heartbeats) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func Test_RegisterRejectsShortTTL(t *testing.T) {
+	mem := NewMemoryBackend()
+	r := NewRegistry(mem)
+	defer r.Close()
+
+	for _, ttl := range []time.Duration{-time.Second, 0, 500 * time.Millisecond, time.Second - 1} {
+		assert.ErrorIs(t, r.RegisterTTL("serviceA", 1, ttl), ErrInvalidTTL, ttl.String())
+		assert.ErrorIs(t, r.RegisterWithKeepAlive(context.Background(), "serviceA", 1, ttl), ErrInvalidTTL, ttl.String())
+	}
+	assert.Empty(t, mem.entries)
+	r.kaMu.Lock()
+	assert.Empty(t, r.heartbeats)
+	r.kaMu.Unlock()
+
+	assert.NoError(t, r.RegisterTTL("serviceA", 1, time.Second))
+}
+
+func autoUnregisterKeysAPI(deleted chan string) *fakeKeysAPI {
+	return &fakeKeysAPI{
+		set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+			return &client.Response{}, nil
+		},
+		delete: func(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+			deleted <- key
+			return &client.Response{}, nil
+		},
+	}
+}
+
+func Test_RegisterAndAutoUnregisterCleanup(t *testing.T) {
+	deleted := make(chan string, 2)
+	kapi := autoUnregisterKeysAPI(deleted)
+	r := NewRegistry(kapi)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cleanup, err := r.RegisterAndAutoUnregister(ctx, "serviceA", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kapi.sets)
+
+	cleanup()
+	cleanup()
+	cancel()
+	assert.Equal(t, RegistryPath+"/serviceA/tcp:1", <-deleted)
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 0, len(deleted), "cleanup should unregister only once")
+}
+
+func Test_RegisterAndAutoUnregisterOnCancel(t *testing.T) {
+	deleted := make(chan string, 1)
+	r := NewRegistry(autoUnregisterKeysAPI(deleted))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := r.RegisterAndAutoUnregister(ctx, "serviceA", 1)
+	assert.NoError(t, err)
+
+	cancel()
+	select {
+	case key := <-deleted:
+		assert.Equal(t, RegistryPath+"/serviceA/tcp:1", key)
+	case <-time.After(time.Second):
+		t.Fatal("key was not deleted after cancel")
+	}
+}
+
+func Test_RegisterAndAutoUnregisterInvalid(t *testing.T) {
+	cleanup, err := NewRegistry(autoUnregisterKeysAPI(nil)).RegisterAndAutoUnregister(context.Background(), "", 1)
+	assert.Error(t, err)
+	assert.Nil(t, cleanup)
+}
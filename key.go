@@ -0,0 +1,104 @@
+package portmapper
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+)
+
+// Key returns the etcd key the package-level functions store the tcp service
+// name on port at, for tools such as backups that work on etcd directly.
+func Key(name string, port int) string {
+	return (&Service{Name: name, Port: port}).Key()
+}
+
+// Key returns the etcd key s is stored at by the package-level functions,
+// protocol included. Registry.Key gives the key within a registry that has
+// its own prefix.
+func (s *Service) Key() string {
+	return s.path()
+}
+
+// Key returns the etcd key svc is stored at in this registry.
+func (r *Registry) Key(svc *Service) string {
+	return r.path(svc)
+}
+
+// parseKey recovers a service's identity from its etcd key below root. It
+// understands both root/name/protocol:port and the older root/name:port.
+func parseKey(root, key string) (*Service, bool) {
+	if !strings.HasPrefix(key, root+"/") {
+		return nil, false
+	}
+
+	svc := &Service{}
+	rest := strings.TrimPrefix(key, root+"/")
+	if i := strings.Index(rest, "/"); i >= 0 {
+		svc.Name, rest = rest[:i], rest[i+1:]
+	}
+
+	i := strings.LastIndex(rest, ":")
+	if i < 0 || strings.Contains(rest, "/") {
+		return nil, false
+	}
+	if svc.Name == "" {
+		svc.Name = rest[:i]
+	} else {
+		svc.Protocol = rest[:i]
+	}
+
+	port, err := strconv.Atoi(rest[i+1:])
+	if err != nil || svc.Name == "" {
+		return nil, false
+	}
+	svc.Port = port
+
+	return svc, true
+}
+
+// serviceFromNode returns the service stored at node, decoding its value with
+// codec. The key is authoritative for Name, Port and Protocol: missing fields
+// in the value are filled in from it and conflicting ones are overridden,
+// since the key is what Unregister will delete.
+func serviceFromNode(root string, codec Codec, node *client.Node) (*Service, error) {
+	fromKey, keyOK := parseKey(root, node.Key)
+
+	// an entry rebuilt from its key alone predates versioning too
+	svc := &Service{SchemaVersion: 1}
+	if strings.TrimSpace(node.Value) != "" {
+		var err error
+		if svc, err = codec.Unmarshal([]byte(node.Value)); err != nil {
+			return nil, err
+		}
+	} else if !keyOK {
+		return nil, errors.New("empty value at unrecognised key " + node.Key)
+	}
+
+	if !keyOK {
+		svc.ModifiedIndex = node.ModifiedIndex
+		return svc, nil
+	}
+
+	if svc.Name != fromKey.Name || svc.Port != fromKey.Port ||
+		(fromKey.Protocol != "" && svc.protocol() != fromKey.Protocol) {
+		if node.Value != "" {
+			logger().Warn("Service entry disagrees with its key. Using the key", Fields{
+				"key":      node.Key,
+				"service":  svc.Name,
+				"port":     svc.Port,
+				"protocol": svc.Protocol,
+			})
+		}
+		svc.Name = fromKey.Name
+		svc.Port = fromKey.Port
+		if fromKey.Protocol != "" {
+			svc.Protocol = fromKey.Protocol
+		}
+	}
+	svc.Protocol = svc.protocol()
+	svc.ModifiedIndex = node.ModifiedIndex
+
+	return svc, nil
+}
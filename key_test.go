@@ -0,0 +1,89 @@
+package portmapper
+
+import (
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Key(t *testing.T) {
+	assert.Equal(t, RegistryPath+"/serviceA/tcp:1", Key("serviceA", 1))
+	assert.Equal(t, (&Service{Name: "serviceA", Port: 1}).path(), Key("serviceA", 1))
+
+	udp := &Service{Name: "serviceA", Port: 53, Protocol: ProtocolUDP}
+	assert.Equal(t, RegistryPath+"/serviceA/udp:53", udp.Key())
+	assert.Equal(t, udp.path(), udp.Key())
+
+	r := NewRegistryWithPrefix(NewMemoryBackend(), "/elsewhere")
+	assert.Equal(t, "/elsewhere/serviceA/udp:53", r.Key(udp))
+	assert.Equal(t, r.path(udp), r.Key(udp))
+
+	// the key round-trips through parseKey
+	svc, ok := parseKey(RegistryPath, udp.Key())
+	if assert.True(t, ok) {
+		assert.Equal(t, udp, svc)
+	}
+}
+
+func Test_ParseKey(t *testing.T) {
+	tests := []struct {
+		key string
+		svc *Service
+	}{
+		{RegistryPath + "/serviceA/tcp:1", &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP}},
+		{RegistryPath + "/serviceA/udp:53", &Service{Name: "serviceA", Port: 53, Protocol: ProtocolUDP}},
+		{RegistryPath + "/serviceA:8080", &Service{Name: "serviceA", Port: 8080}},
+		{RegistryPath + "/serviceA", nil},
+		{RegistryPath + "/serviceA:http", nil},
+		{RegistryPath + "/:80", nil},
+		{RegistryPath + "/a/b/tcp:1", nil},
+		{"/elsewhere/serviceA/tcp:1", nil},
+	}
+
+	for _, test := range tests {
+		svc, ok := parseKey(RegistryPath, test.key)
+		if test.svc == nil {
+			assert.False(t, ok, test.key)
+		} else if assert.True(t, ok, test.key) {
+			assert.Equal(t, test.svc, svc, test.key)
+		}
+	}
+}
+
+func Test_ServiceFromNode(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		svc   *Service
+	}{
+		// value and key agree
+		{RegistryPath + "/serviceA/tcp:1", `{"name":"serviceA","port":1,"hostname":"host1"}`,
+			&Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "host1", SchemaVersion: 1}},
+		// empty and partial values are filled in from the key
+		{RegistryPath + "/serviceA/udp:53", "",
+			&Service{Name: "serviceA", Port: 53, Protocol: ProtocolUDP, SchemaVersion: 1}},
+		{RegistryPath + "/serviceA:8080", `{"hostname":"host1"}`,
+			&Service{Name: "serviceA", Port: 8080, Protocol: ProtocolTCP, Hostname: "host1", SchemaVersion: 1}},
+		// the key wins when the value disagrees
+		{RegistryPath + "/serviceA/tcp:1", `{"name":"serviceB","port":2,"protocol":"udp","hostname":"host1"}`,
+			&Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "host1", SchemaVersion: 1}},
+		{RegistryPath + "/serviceA:1", `{"name":"serviceB","port":1}`,
+			&Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, SchemaVersion: 1}},
+		// keys that don't parse fall back to the value alone
+		{RegistryPath + "/odd", `{"name":"serviceC","port":3}`,
+			&Service{Name: "serviceC", Port: 3, Protocol: ProtocolTCP, SchemaVersion: 1}},
+	}
+
+	for _, test := range tests {
+		svc, err := serviceFromNode(RegistryPath, JSONCodec{}, &client.Node{Key: test.key, Value: test.value})
+		if assert.NoError(t, err, test.key) {
+			assert.Equal(t, test.svc, svc, test.key)
+		}
+	}
+
+	_, err := serviceFromNode(RegistryPath, JSONCodec{}, &client.Node{Key: RegistryPath + "/odd"})
+	assert.Error(t, err)
+	_, err = serviceFromNode(RegistryPath, JSONCodec{}, &client.Node{Key: RegistryPath + "/serviceA/tcp:1", Value: "{"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,118 @@
+package portmapper
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Fields are the structured values attached to a log message.
+type Fields map[string]interface{}
+
+// with returns a copy of f that also holds extra.
+func (f Fields) with(extra Fields) Fields {
+	merged := make(Fields, len(f)+len(extra))
+	for k, v := range f {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+	return merged
+}
+
+// Logger receives everything the package logs. Implement it to route
+// portmapper's messages through an application's own logging.
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+var (
+	loggerMu  sync.RWMutex
+	pkgLogger Logger = logrusLogger{}
+)
+
+// SetLogger makes the package log through l instead of the standard logrus
+// logger. SetLogger(nil) silences the package entirely.
+func SetLogger(l Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+
+	if l == nil {
+		l = noopLogger{}
+	}
+	pkgLogger = l
+}
+
+// logger returns the Logger installed with SetLogger.
+func logger() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+
+	return pkgLogger
+}
+
+// LogrusLogger returns a Logger writing through l, for passing to SetLogger
+// when portmapper's messages should be formatted or sent somewhere apart
+// from the standard logrus logger's.
+func LogrusLogger(l *log.Logger) Logger {
+	return logrusLogger{l}
+}
+
+// SetJSONLogging makes the package log JSON, one object per message, or
+// goes back to the default text logging if json is false. The JSON goes
+// wherever the standard logrus logger writes to at the time of the call,
+// at its level, and the standard logger itself is left as it is.
+func SetJSONLogging(json bool) {
+	if !json {
+		SetLogger(logrusLogger{})
+		return
+	}
+
+	SetLogger(LogrusLogger(&log.Logger{
+		Out:       log.StandardLogger().Out,
+		Formatter: &log.JSONFormatter{},
+		Hooks:     make(log.LevelHooks),
+		Level:     log.GetLevel(),
+	}))
+}
+
+// logrusLogger writes through l, or through the standard logrus logger if l
+// is nil, as it is by default.
+type logrusLogger struct {
+	l *log.Logger
+}
+
+func (l logrusLogger) entry(fields Fields) *log.Entry {
+	if l.l == nil {
+		return log.WithFields(log.Fields(fields))
+	}
+	return l.l.WithFields(log.Fields(fields))
+}
+
+func (l logrusLogger) Debug(msg string, fields Fields) {
+	l.entry(fields).Debug(msg)
+}
+
+func (l logrusLogger) Info(msg string, fields Fields) {
+	l.entry(fields).Info(msg)
+}
+
+func (l logrusLogger) Warn(msg string, fields Fields) {
+	l.entry(fields).Warn(msg)
+}
+
+func (l logrusLogger) Error(msg string, fields Fields) {
+	l.entry(fields).Error(msg)
+}
+
+// noopLogger discards everything.
+type noopLogger struct{}
+
+func (noopLogger) Debug(string, Fields) {}
+func (noopLogger) Info(string, Fields)  {}
+func (noopLogger) Warn(string, Fields)  {}
+func (noopLogger) Error(string, Fields) {}
@@ -0,0 +1,142 @@
+package portmapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+type logEntry struct {
+	level  string
+	msg    string
+	fields Fields
+}
+
+// captureLogger is a Logger that records every message it receives.
+type captureLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (c *captureLogger) log(level, msg string, fields Fields) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = append(c.entries, logEntry{level, msg, fields})
+}
+
+func (c *captureLogger) Debug(msg string, fields Fields) { c.log("debug", msg, fields) }
+func (c *captureLogger) Info(msg string, fields Fields)  { c.log("info", msg, fields) }
+func (c *captureLogger) Warn(msg string, fields Fields)  { c.log("warn", msg, fields) }
+func (c *captureLogger) Error(msg string, fields Fields) { c.log("error", msg, fields) }
+
+// useLogger installs l until the returned func is called.
+func useLogger(l Logger) func() {
+	orig := logger()
+	SetLogger(l)
+	return func() { SetLogger(orig) }
+}
+
+func Test_SetLoggerCapturesRegistration(t *testing.T) {
+	capture := &captureLogger{}
+	defer useLogger(capture)()
+
+	r := NewRegistry(NewMemoryBackend())
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.Error(t, r.Register("serviceA", 0))
+
+	if assert.Equal(t, 2, len(capture.entries)) {
+		assert.Equal(t, "info", capture.entries[0].level)
+		assert.Equal(t, "Successfully registered service with etcd", capture.entries[0].msg)
+		assert.Equal(t, "serviceA", capture.entries[0].fields["service"])
+		assert.Equal(t, RegistryPath+"/serviceA/tcp:1", capture.entries[0].fields["path"])
+
+		assert.Equal(t, "error", capture.entries[1].level)
+		assert.Equal(t, "Service Validation Failed.", capture.entries[1].msg)
+	}
+}
+
+func Test_SetLoggerNilIsQuiet(t *testing.T) {
+	var out bytes.Buffer
+	std := log.StandardLogger()
+	origOut := std.Out
+	std.Out = &out
+	defer func() { std.Out = origOut }()
+
+	defer useLogger(nil)()
+
+	r := NewRegistry(NewMemoryBackend())
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.Error(t, r.Register("serviceA", 0))
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	_, err := r.Services()
+	assert.NoError(t, err)
+
+	assert.Equal(t, "", out.String())
+}
+
+func Test_RetryLogsEndpoints(t *testing.T) {
+	capture := &captureLogger{}
+	defer useLogger(capture)()
+
+	r := NewRegistry(timeoutKeysAPI(),
+		WithEndpoints("http://10.0.0.1:2379", "http://10.0.0.2:2379"),
+		WithRetryPolicy(RetryPolicy{MaxRetries: 2, Timeout: time.Second, BackoffBase: time.Millisecond}))
+	assert.Error(t, r.Register("serviceA", 1))
+
+	levels := map[string]bool{}
+	for _, entry := range capture.entries {
+		levels[entry.level] = true
+		assert.Equal(t, "http://10.0.0.1:2379,http://10.0.0.2:2379", entry.fields["endpoints"], entry.msg)
+	}
+	assert.True(t, levels["warn"])
+	assert.True(t, levels["error"])
+
+	// the package-level registry names the configured endpoints
+	defer useConfig(client.Config{Endpoints: []string{"http://10.0.0.3:2379"}, Transport: client.DefaultTransport})()
+	reg, err := defaultRegistry()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"http://10.0.0.3:2379"}, reg.endpoints)
+}
+
+func Test_SetJSONLogging(t *testing.T) {
+	var out bytes.Buffer
+	std := log.StandardLogger()
+	origOut, origFormatter := std.Out, std.Formatter
+	std.Out = &out
+	defer func() { std.Out = origOut }()
+	defer useLogger(logger())()
+
+	SetJSONLogging(true)
+	r := NewRegistry(NewMemoryBackend())
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.Error(t, r.Register("serviceA", 0))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+		assert.Equal(t, "info", entry["level"])
+		assert.Equal(t, "Successfully registered service with etcd", entry["msg"])
+		assert.Equal(t, "serviceA", entry["service"])
+		assert.Equal(t, float64(1), entry["port"])
+
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+		assert.Equal(t, "error", entry["level"])
+	}
+	// the application's own logging is untouched
+	assert.Equal(t, origFormatter, std.Formatter)
+
+	out.Reset()
+	SetJSONLogging(false)
+	assert.NoError(t, r.Register("serviceA", 2))
+	assert.Contains(t, out.String(), `msg="Successfully registered service with etcd"`)
+	assert.False(t, json.Valid(out.Bytes()))
+}
@@ -0,0 +1,302 @@
+package portmapper
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// maxMemoryEvents is how many changes a MemoryBackend keeps for watchers
+// that fall behind.
+const maxMemoryEvents = 1000
+
+// MemoryBackend is a Backend that keeps keys in memory, for tests and local
+// development without an etcd. It follows etcd's directory semantics closely
+// enough for a Registry: gets of a directory list what is below it, deletes
+// may be recursive, TTLs expire and watchers see every change. A recursive
+// delete is reported to watchers as one delete per key rather than one for
+// the directory.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	index   uint64
+	entries map[string]*memEntry
+
+	// events holds the latest changes in index order; changed is closed and
+	// replaced whenever one is added
+	events  []*client.Response
+	changed chan struct{}
+
+	now func() time.Time
+}
+
+type memEntry struct {
+	value    string
+	created  uint64
+	modified uint64
+	expires  time.Time
+}
+
+// NewMemoryBackend returns an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		entries: map[string]*memEntry{},
+		changed: make(chan struct{}),
+		now:     time.Now,
+	}
+}
+
+// NewInMemoryRegistry returns a Registry over a new MemoryBackend.
+func NewInMemoryRegistry(opts ...Option) *Registry {
+	return NewRegistry(NewMemoryBackend(), opts...)
+}
+
+func notFound(key string, index uint64) error {
+	return client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key, Index: index}
+}
+
+func (m *MemoryBackend) node(key string) *client.Node {
+	e := m.entries[key]
+	n := &client.Node{Key: key, Value: e.value, CreatedIndex: e.created, ModifiedIndex: e.modified}
+	if !e.expires.IsZero() {
+		n.Expiration = &e.expires
+		n.TTL = int64(e.expires.Sub(m.now()).Seconds())
+	}
+	return n
+}
+
+// record adds a change for watchers. The caller holds mu.
+func (m *MemoryBackend) record(resp *client.Response) {
+	resp.Index = m.index
+	m.events = append(m.events, resp)
+	if len(m.events) > maxMemoryEvents {
+		m.events = m.events[len(m.events)-maxMemoryEvents:]
+	}
+
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// expire removes entries whose TTL has passed. The caller holds mu.
+func (m *MemoryBackend) expire() {
+	now := m.now()
+
+	var keys []string
+	for k, e := range m.entries {
+		if !e.expires.IsZero() && !now.Before(e.expires) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		prev := m.node(k)
+		delete(m.entries, k)
+		m.index++
+		m.record(&client.Response{
+			Action:   "expire",
+			Node:     &client.Node{Key: k, ModifiedIndex: m.index},
+			PrevNode: prev,
+		})
+	}
+}
+
+// Get returns the value at key or, if key is a directory, the entries below
+// it.
+func (m *MemoryBackend) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	if _, ok := m.entries[key]; ok {
+		return &client.Response{Action: "get", Node: m.node(key), Index: m.index}, nil
+	}
+
+	dir := strings.TrimSuffix(key, "/")
+	var keys []string
+	for k := range m.entries {
+		if strings.HasPrefix(k, dir+"/") {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 && dir != "" {
+		return nil, notFound(key, m.index)
+	}
+	sort.Strings(keys)
+
+	recursive := opts != nil && opts.Recursive
+	root := &client.Node{Key: key, Dir: true}
+	dirs := map[string]*client.Node{dir: root}
+	child := func(parent *client.Node, k string) *client.Node {
+		d, ok := dirs[k]
+		if !ok {
+			d = &client.Node{Key: k, Dir: true}
+			dirs[k] = d
+			parent.Nodes = append(parent.Nodes, d)
+		}
+		return d
+	}
+
+	for _, k := range keys {
+		parts := strings.Split(strings.TrimPrefix(k, dir+"/"), "/")
+		if !recursive && len(parts) > 1 {
+			// only list the child directory, not what is in it
+			child(root, dir+"/"+parts[0])
+			continue
+		}
+
+		parent := root
+		for i := range parts[:len(parts)-1] {
+			parent = child(parent, dir+"/"+strings.Join(parts[:i+1], "/"))
+		}
+		parent.Nodes = append(parent.Nodes, m.node(k))
+	}
+
+	return &client.Response{Action: "get", Node: root, Index: m.index}, nil
+}
+
+// Set writes value at key, honouring PrevExist and TTL.
+func (m *MemoryBackend) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	if opts == nil {
+		opts = &client.SetOptions{}
+	}
+
+	prev, exists := m.entries[key]
+	if opts.PrevExist == client.PrevNoExist && exists {
+		return nil, client.Error{Code: client.ErrorCodeNodeExist, Message: "Key already exists", Cause: key, Index: m.index}
+	}
+	if opts.PrevExist == client.PrevExist && !exists {
+		return nil, notFound(key, m.index)
+	}
+
+	resp := &client.Response{Action: "set"}
+	if exists {
+		resp.PrevNode = m.node(key)
+	}
+
+	m.index++
+	e := &memEntry{value: value, created: m.index, modified: m.index}
+	if exists {
+		e.created = prev.created
+	}
+	if opts.TTL > 0 {
+		e.expires = m.now().Add(opts.TTL)
+	}
+	m.entries[key] = e
+
+	resp.Node = m.node(key)
+	m.record(resp)
+	return resp, nil
+}
+
+// Delete removes key, or every key below it when opts.Recursive is set. As
+// in etcd, a recursive delete is a single change to the directory.
+func (m *MemoryBackend) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire()
+
+	if _, ok := m.entries[key]; ok {
+		prev := m.node(key)
+		delete(m.entries, key)
+		m.index++
+		resp := &client.Response{
+			Action:   "delete",
+			Node:     &client.Node{Key: key, ModifiedIndex: m.index},
+			PrevNode: prev,
+		}
+		m.record(resp)
+		return resp, nil
+	}
+
+	if opts == nil || !opts.Recursive {
+		return nil, notFound(key, m.index)
+	}
+
+	var keys []string
+	for k := range m.entries {
+		if strings.HasPrefix(k, key+"/") {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, notFound(key, m.index)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		delete(m.entries, k)
+	}
+	m.index++
+	resp := &client.Response{
+		Action:   "delete",
+		Node:     &client.Node{Key: key, Dir: true, ModifiedIndex: m.index},
+		PrevNode: &client.Node{Key: key, Dir: true},
+	}
+	m.record(resp)
+	return resp, nil
+}
+
+// Watcher returns a watcher for changes to key, and to everything below it
+// if opts.Recursive is set, after opts.AfterIndex or else from now on.
+func (m *MemoryBackend) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w := &memWatcher{m: m, key: key, after: m.index}
+	if opts != nil {
+		w.recursive = opts.Recursive
+		if opts.AfterIndex > 0 {
+			w.after = opts.AfterIndex
+		}
+	}
+	return w
+}
+
+type memWatcher struct {
+	m         *MemoryBackend
+	key       string
+	recursive bool
+	after     uint64
+}
+
+func (w *memWatcher) matches(key string) bool {
+	return key == w.key || (w.recursive && strings.HasPrefix(key, strings.TrimSuffix(w.key, "/")+"/"))
+}
+
+// Next returns the first matching change after the last one returned,
+// blocking until there is one or ctx is done. TTLs are only noticed when the
+// backend is next used, so an expiry may be reported late.
+func (w *memWatcher) Next(ctx context.Context) (*client.Response, error) {
+	for {
+		w.m.mu.Lock()
+		if len(w.m.events) > 0 && w.m.events[0].Index > w.after+1 {
+			w.m.mu.Unlock()
+			return nil, client.Error{Code: client.ErrorCodeEventIndexCleared, Message: "The event in requested index is outdated and cleared", Cause: w.key}
+		}
+		for _, resp := range w.m.events {
+			if resp.Index > w.after {
+				w.after = resp.Index
+				if w.matches(resp.Node.Key) {
+					w.m.mu.Unlock()
+					return resp, nil
+				}
+			}
+		}
+		changed := w.m.changed
+		w.m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package portmapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_InMemoryRegistry(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	r := NewInMemoryRegistry()
+
+	assert.NoError(t, r.Ping(context.Background()))
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.NoError(t, r.Register("serviceA", 2))
+	assert.NoError(t, r.RegisterWithAddress("serviceB", 3, "10.0.0.1"))
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Service{
+		{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "host1", SchemaVersion: 1, ModifiedIndex: 1},
+		{Name: "serviceA", Port: 2, Protocol: ProtocolTCP, Hostname: "host1", SchemaVersion: 1, ModifiedIndex: 2},
+		{Name: "serviceB", Port: 3, Protocol: ProtocolTCP, Hostname: "host1", Address: "10.0.0.1", SchemaVersion: 1, ModifiedIndex: 3},
+	}, services)
+
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	count, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func Test_InMemoryWatch(t *testing.T) {
+	r := NewInMemoryRegistry()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := r.Watch(ctx)
+	assert.NoError(t, err)
+
+	svcA := &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "host1"}
+	assert.NoError(t, r.RegisterAll([]*Service{svcA}))
+	assert.NoError(t, r.RegisterWithHostname("serviceA", 1, "host2"))
+	assert.NoError(t, r.RegisterWithHostname("serviceA", 2, "host2"))
+	n, err := r.UnregisterService("serviceA")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	expected := []struct {
+		typ      EventType
+		port     int
+		hostname string
+	}{
+		{Added, 1, "host1"},
+		{Modified, 1, "host2"},
+		{Added, 2, "host2"},
+		{Deleted, 1, "host2"},
+		{Deleted, 2, "host2"},
+	}
+	for _, want := range expected {
+		select {
+		case got := <-events:
+			assert.Equal(t, want.typ, got.Type)
+			assert.Equal(t, want.port, got.Service.Port)
+			assert.Equal(t, want.hostname, got.Service.Hostname)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+}
+
+func Test_MemoryBackendTTL(t *testing.T) {
+	m := NewMemoryBackend()
+	now := time.Unix(1000, 0)
+	m.now = func() time.Time { return now }
+	r := NewRegistry(m)
+
+	w := m.Watcher(RegistryPath, &client.WatcherOptions{Recursive: true})
+	assert.NoError(t, r.RegisterTTL("serviceA", 1, 30*time.Second))
+
+	now = now.Add(29 * time.Second)
+	registered, err := r.IsRegistered("serviceA", 1)
+	assert.NoError(t, err)
+	assert.True(t, registered)
+
+	now = now.Add(time.Second)
+	registered, err = r.IsRegistered("serviceA", 1)
+	assert.NoError(t, err)
+	assert.False(t, registered)
+
+	ctx := context.Background()
+	resp, err := w.Next(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "set", resp.Action)
+	}
+	resp, err = w.Next(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "expire", resp.Action)
+		assert.Equal(t, RegistryPath+"/serviceA/tcp:1", resp.PrevNode.Key)
+	}
+}
+
+func Test_MemoryWatcherFallsBehind(t *testing.T) {
+	m := NewMemoryBackend()
+	w := m.Watcher(RegistryPath, &client.WatcherOptions{Recursive: true})
+
+	for i := 0; i < maxMemoryEvents+1; i++ {
+		m.Set(context.Background(), RegistryPath+"/serviceA/tcp:1", "{}", nil)
+	}
+
+	_, err := w.Next(context.Background())
+	if cerr, ok := err.(client.Error); assert.True(t, ok) {
+		assert.Equal(t, client.ErrorCodeEventIndexCleared, cerr.Code)
+	}
+}
+
+func Test_MemoryRecursiveDelete(t *testing.T) {
+	m := NewMemoryBackend()
+	ctx := context.Background()
+	for _, key := range []string{"/serviceA/tcp:1", "/serviceA/tcp:2"} {
+		_, err := m.Set(ctx, RegistryPath+key, "{}", nil)
+		assert.NoError(t, err)
+	}
+	w := m.Watcher(RegistryPath, &client.WatcherOptions{Recursive: true})
+
+	// as in etcd, a single change to the directory
+	_, err := m.Delete(ctx, RegistryPath+"/serviceA", &client.DeleteOptions{Recursive: true})
+	assert.NoError(t, err)
+	resp, err := w.Next(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "delete", resp.Action)
+		assert.Equal(t, RegistryPath+"/serviceA", resp.Node.Key)
+		assert.True(t, resp.Node.Dir)
+	}
+	assert.Equal(t, 0, len(m.entries))
+}
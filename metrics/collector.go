@@ -0,0 +1,73 @@
+// Package metrics exports the portmapper registry to Prometheus.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	portmapper "github.com/opsee/pomapper"
+)
+
+// Lister enumerates registered services. *portmapper.Registry satisfies it.
+type Lister interface {
+	Services() ([]*portmapper.Service, error)
+}
+
+// listerFunc adapts a function such as portmapper.Services to Lister.
+type listerFunc func() ([]*portmapper.Service, error)
+
+func (f listerFunc) Services() ([]*portmapper.Service, error) {
+	return f()
+}
+
+var (
+	registeredDesc = prometheus.NewDesc(
+		"pomapper_registered_services",
+		"Number of registered instances of each service.",
+		[]string{"name"}, nil,
+	)
+	scrapeErrorDesc = prometheus.NewDesc(
+		"pomapper_scrape_error",
+		"1 if the last enumeration of the registry failed, 0 otherwise.",
+		nil, nil,
+	)
+)
+
+// Collector is a prometheus.Collector that enumerates the registry on every
+// scrape.
+type Collector struct {
+	lister Lister
+}
+
+// NewCollector returns a Collector reporting the services l lists. A nil l
+// uses the package-level portmapper.Services.
+func NewCollector(l Lister) *Collector {
+	if l == nil {
+		l = listerFunc(portmapper.Services)
+	}
+	return &Collector{lister: l}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- registeredDesc
+	ch <- scrapeErrorDesc
+}
+
+// Collect implements prometheus.Collector. A failed enumeration is reported
+// through pomapper_scrape_error and emits no per-service gauges.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	services, err := c.lister.Services()
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, 1)
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, svc := range services {
+		counts[svc.Name]++
+	}
+	for name, n := range counts {
+		ch <- prometheus.MustNewConstMetric(registeredDesc, prometheus.GaugeValue, float64(n), name)
+	}
+	ch <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, 0)
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	portmapper "github.com/opsee/pomapper"
+)
+
+type fakeLister struct {
+	services []*portmapper.Service
+	err      error
+}
+
+func (f *fakeLister) Services() ([]*portmapper.Service, error) {
+	return f.services, f.err
+}
+
+func Test_CollectorCountsInstances(t *testing.T) {
+	lister := &fakeLister{services: []*portmapper.Service{
+		{Name: "serviceA", Port: 1, Hostname: "host1"},
+		{Name: "serviceA", Port: 1, Hostname: "host2"},
+		{Name: "serviceB", Port: 2, Hostname: "host1"},
+	}}
+
+	reg := prometheus.NewPedanticRegistry()
+	assert.NoError(t, reg.Register(NewCollector(lister)))
+
+	expected := `
+# HELP pomapper_registered_services Number of registered instances of each service.
+# TYPE pomapper_registered_services gauge
+pomapper_registered_services{name="serviceA"} 2
+pomapper_registered_services{name="serviceB"} 1
+# HELP pomapper_scrape_error 1 if the last enumeration of the registry failed, 0 otherwise.
+# TYPE pomapper_scrape_error gauge
+pomapper_scrape_error 0
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected)))
+}
+
+func Test_CollectorReportsScrapeError(t *testing.T) {
+	lister := &fakeLister{err: errors.New("etcd unavailable")}
+
+	reg := prometheus.NewPedanticRegistry()
+	assert.NoError(t, reg.Register(NewCollector(lister)))
+
+	expected := `
+# HELP pomapper_scrape_error 1 if the last enumeration of the registry failed, 0 otherwise.
+# TYPE pomapper_scrape_error gauge
+pomapper_scrape_error 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected)))
+}
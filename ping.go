@@ -0,0 +1,31 @@
+package portmapper
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// pingTimeout bounds a Ping so a readiness probe fails fast rather than
+// waiting out the full retry policy.
+const pingTimeout = time.Second
+
+// Ping reports whether etcd answers a single read of "/" within a second, or
+// before ctx is done if that is sooner. It does not retry, so it suits
+// readiness probes run before Register.
+func (r *Registry) Ping(ctx context.Context) error {
+	if err := r.checkOpen(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	if _, err := r.backend.Get(ctx, "/", nil); err != nil {
+		logger().Warn("etcd ping failed", Fields{"action": "Ping", "errstr": err.Error()})
+		return fmt.Errorf("etcd unreachable: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package portmapper
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_Ping(t *testing.T) {
+	var key string
+	kapi := &fakeKeysAPI{get: func(ctx context.Context, k string, opts *client.GetOptions) (*client.Response, error) {
+		key = k
+		_, ok := ctx.Deadline()
+		assert.True(t, ok, "ping should carry a deadline")
+		return &client.Response{Node: &client.Node{Key: "/", Dir: true}}, nil
+	}}
+
+	assert.NoError(t, NewRegistry(kapi).Ping(context.Background()))
+	assert.Equal(t, "/", key)
+	assert.Equal(t, 1, kapi.gets)
+}
+
+func Test_PingFailure(t *testing.T) {
+	down := errors.New("connection refused")
+	kapi := &fakeKeysAPI{get: func(ctx context.Context, k string, opts *client.GetOptions) (*client.Response, error) {
+		return nil, down
+	}}
+
+	err := NewRegistry(kapi).Ping(context.Background())
+	assert.True(t, errors.Is(err, down))
+	// a probe doesn't retry
+	assert.Equal(t, 1, kapi.gets)
+
+	timeouts := timeoutKeysAPI()
+	err = NewRegistry(timeouts).Ping(context.Background())
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, 1, timeouts.gets)
+}
@@ -4,10 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/coreos/etcd/client"
 	"golang.org/x/net/context"
 )
@@ -27,46 +32,394 @@ var (
 		Endpoints: []string{EtcdHost},
 		Transport: client.DefaultTransport,
 		// set timeout per request to fail fast when the target endpoint is unavailable
-		HeaderTimeoutPerRequest: time.Second,
+		HeaderTimeoutPerRequest: DefaultHeaderTimeout,
 	}
+
+	// lazily initialized Registry used by the package-level functions.
+	// defaultMu guards it and cfg, so concurrent first calls and the Set
+	// functions don't race. A sync.Once wouldn't do, since a failed init is
+	// retried and the Set functions start over with a new client.
+	defaultMu  sync.Mutex
+	defaultReg *Registry
 )
 
 func init() {
-	if len(os.Getenv("ETCD_HOST")) > 0 {
-		cfg = client.Config{
-			Endpoints: []string{os.Getenv("ETCD_HOST")},
-			Transport: client.DefaultTransport,
-			// set timeout per request to fail fast when the target endpoint is unavailable
-			HeaderTimeoutPerRequest: time.Second,
+	cfg.Endpoints = ParseEndpoints(os.Getenv("ETCD_HOST"))
+}
+
+// ParseEndpoints splits a list of etcd endpoints, such as an ETCD_HOST value,
+// on commas and whitespace, dropping empty ones. With none left it falls back
+// to EtcdHost, since client.New can't make sense of an empty list.
+func ParseEndpoints(s string) []string {
+	endpoints := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(endpoints) == 0 {
+		return []string{EtcdHost}
+	}
+
+	return endpoints
+}
+
+// SetEndpoints replaces the etcd endpoints used by the package-level
+// functions. It must be called before the first Register, Unregister or
+// Services call.
+func SetEndpoints(endpoints []string) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	cfg.Endpoints = endpoints
+	defaultReg = nil
+}
+
+// SetCredentials sets the username and password the package-level functions
+// use to authenticate with an etcd cluster that has auth enabled. Empty
+// credentials leave the client unauthenticated. Like SetEndpoints it must be
+// called before the first Register, Unregister or Services call.
+func SetCredentials(username, password string) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	cfg.Username = username
+	cfg.Password = password
+	defaultReg = nil
+}
+
+// DefaultHeaderTimeout bounds how long each etcd request waits for response
+// headers unless SetHeaderTimeout says otherwise.
+const DefaultHeaderTimeout = time.Second
+
+// SetHeaderTimeout sets how long each etcd request made by the package-level
+// functions waits for response headers before it is retried. Links with high
+// latency may need more than DefaultHeaderTimeout. Zero or less restores the
+// default. Like SetEndpoints it must be called before the first Register,
+// Unregister or Services call.
+func SetHeaderTimeout(d time.Duration) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if d <= 0 {
+		d = DefaultHeaderTimeout
+	}
+	cfg.HeaderTimeoutPerRequest = d
+	defaultReg = nil
+}
+
+// newClient builds an etcd client from cfg.
+func newClient() (client.Client, error) {
+	return client.New(cfg)
+}
+
+// newKeysAPI builds an etcd keys API from cfg.
+func newKeysAPI() (client.KeysAPI, error) {
+	c, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.NewKeysAPI(c), nil
+}
+
+// ErrNoEndpoints is returned by the package-level functions when no etcd
+// endpoint has been configured, e.g. after SetEndpoints(nil).
+var ErrNoEndpoints = errors.New("no etcd endpoints configured")
+
+// checkEndpoints returns ErrNoEndpoints unless at least one of endpoints is
+// non-blank.
+func checkEndpoints(endpoints []string) error {
+	for _, e := range endpoints {
+		if strings.TrimSpace(e) != "" {
+			return nil
 		}
 	}
+
+	return ErrNoEndpoints
+}
+
+// defaultRegistry returns the Registry behind the package-level functions,
+// creating it on first use. A failed client init is not cached, so a later
+// call can try again.
+func defaultRegistry() (*Registry, error) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if defaultReg == nil {
+		if err := checkEndpoints(cfg.Endpoints); err != nil {
+			logger().Error("Error initializing etcd client", Fields{"service": "portmapper", "errstr": err.Error()})
+			return nil, err
+		}
+		kapi, err := newKeysAPI()
+		if err != nil {
+			logger().Error("Error initializing etcd client", Fields{"service": "portmapper", "errstr": err.Error()})
+			return nil, fmt.Errorf("error initializing etcd client: %w", err)
+		}
+		defaultReg = NewRegistry(kapi, WithEndpoints(cfg.Endpoints...))
+	}
+
+	return defaultReg, nil
+}
+
+// isKeyNotFound reports whether err is etcd's "Key not found" error.
+func isKeyNotFound(err error) bool {
+	cerr, ok := err.(client.Error)
+	return ok && cerr.Code == client.ErrorCodeKeyNotFound
 }
 
 // Service is a mapping between a service name and port. It may also contain
 // the hostname where the service is running or the container ID in the
-// Hostname field. It will attempt to get this from the HOSTNAME environment
-// variable.
+// Hostname field. Unless told otherwise it uses the HOSTNAME environment
+// variable, falling back to the kernel's hostname.
 type Service struct {
 	Name     string `json:"name"`
 	Port     int    `json:"port"`
+	Protocol string `json:"protocol,omitempty"`
 	Hostname string `json:"hostname,omitempty"`
+	// Address is the IP consumers should connect to, when Hostname is only an
+	// identity such as a container ID. It is not part of the etcd key.
+	Address string `json:"address,omitempty"`
+	// URL is a ready-to-dial address such as "https://10.0.0.1:8443", for
+	// consumers that would rather not assemble one from the other fields.
+	// Its port must be Port. It is not part of the etcd key.
+	URL string `json:"url,omitempty"`
+
+	// Region is the datacenter or region the service runs in, for consumers
+	// that route to the nearest one. Register fills it in from
+	// POMAPPER_REGION or AWS_REGION when it is empty. It is not part of the
+	// etcd key.
+	Region string `json:"region,omitempty"`
+
+	// Tags are free-form labels such as environment or version.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Weight and Priority guide load balancing as in a DNS SRV record:
+	// consumers prefer the lowest Priority and share load within it in
+	// proportion to Weight. Zero for both is the common case of equal,
+	// top-priority instances. Neither is part of the etcd key.
+	Weight   int `json:"weight,omitempty"`
+	Priority int `json:"priority,omitempty"`
+
+	// Draining is set by Drain on an instance that is shutting down.
+	// Consumers should send it no new requests.
+	Draining bool `json:"draining,omitempty"`
+
+	// SchemaVersion is the version of this format the entry was written in.
+	// Register always writes CurrentSchemaVersion, and entries from before
+	// versioning decode as version 1.
+	SchemaVersion int `json:"schema,omitempty"`
+
+	// ModifiedIndex is the etcd index of the entry's last change, set on
+	// services read from etcd so callers can tell whether an entry changed
+	// since they last saw it. It is never stored.
+	ModifiedIndex uint64 `json:"-"`
+}
+
+// CurrentSchemaVersion is the SchemaVersion of the entries this package
+// writes. Readers of a newer version decode the fields they know and ignore
+// the rest.
+const CurrentSchemaVersion = 1
+
+// Protocols a Service may listen on. An empty Protocol means ProtocolTCP.
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// Validation failures. The errors Validate returns are ValidationErrors
+// wrapping one of these, so callers can tell them apart with errors.Is.
+var (
+	ErrMissingName     = errors.New("Service lacks Name field")
+	ErrInvalidName     = errors.New("Service Name is invalid")
+	ErrInvalidPort     = errors.New("Service Port is outside valid range")
+	ErrInvalidHostname = errors.New("Service Hostname is invalid")
+	ErrInvalidAddress  = errors.New("Service Address is not an IP address")
+	ErrInvalidProtocol = errors.New("Service Protocol must be tcp or udp")
+	ErrReservedTag     = errors.New("Service Tags may not use a reserved key")
+	ErrInvalidWeight   = errors.New("Service Weight or Priority is outside valid range")
+	ErrInvalidRegion   = errors.New("Service Region is too long")
+	ErrInvalidURL      = errors.New("Service URL is invalid")
+)
+
+// MaxRegionLength is the longest Region Validate accepts.
+const MaxRegionLength = 64
+
+// ValidationError is the error returned for a Service that fails validation.
+// It wraps one of the Err sentinels, with any detail, and carries a copy of
+// the Service as it was rejected.
+type ValidationError struct {
+	Service *Service
+	Err     error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Err, e.Service)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// invalid returns a ValidationError for a copy of s.
+func invalid(s *Service, err error) error {
+	return &ValidationError{Service: s.Clone(), Err: err}
+}
+
+// parseURL parses a service URL, which must have a scheme, a host and an
+// explicit port within 1-65535.
+func parseURL(rawurl string) (*url.URL, int, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, 0, err
+	}
+	if u.Scheme == "" || u.Hostname() == "" {
+		return nil, 0, fmt.Errorf("%q needs a scheme and a host", rawurl)
+	}
+	if u.Port() == "" {
+		return nil, 0, fmt.Errorf("%q has no port", rawurl)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil || port < 1 || port > 65535 {
+		return nil, 0, fmt.Errorf("%q has a port outside 1-65535", rawurl)
+	}
+
+	return u, port, nil
 }
 
-// ensure service name has field and valid port
-func (s *Service) validate() error {
-	if s.Name == "" {
-		return fmt.Errorf("Service lacks Name field: %v", s)
+// tag keys that would be confused with the Service's own fields
+var reservedTags = []string{"name", "port", "protocol", "hostname", "address", "weight", "priority", "draining", "schema", "url"}
+
+// Validate checks s the way Register would, without writing anything: the
+// Name must be a usable key segment, the Port within 1-65535, the URL if set
+// an absolute URL naming the Port, the Hostname free of '/' and ':', the
+// Address an IP if set, the Region at most
+// MaxRegionLength bytes, the Protocol tcp or udp, Weight and Priority within
+// 0-65535, and no Tag may use a reserved key.
+// Failures are ValidationErrors. s itself is left unchanged.
+func (s *Service) Validate() error {
+	if err := validateName(s.Name); err != nil {
+		return invalid(s, err)
 	}
 	if s.Port < 1 || s.Port > 65535 {
-		return fmt.Errorf("Service Port is outside valid range: %v", s)
+		return invalid(s, ErrInvalidPort)
+	}
+	if s.URL != "" {
+		if _, port, err := parseURL(s.URL); err != nil {
+			return invalid(s, fmt.Errorf("%w: %v", ErrInvalidURL, err))
+		} else if port != s.Port {
+			return invalid(s, fmt.Errorf("%w: port %d is not the service's %d", ErrInvalidURL, port, s.Port))
+		}
+	}
+	if strings.ContainsAny(s.Hostname, "/:") {
+		return invalid(s, fmt.Errorf("%w: may not contain '/' or ':'", ErrInvalidHostname))
+	}
+	if s.Address != "" && net.ParseIP(s.Address) == nil {
+		return invalid(s, fmt.Errorf("%w: %q", ErrInvalidAddress, s.Address))
+	}
+	if len(s.Region) > MaxRegionLength {
+		return invalid(s, fmt.Errorf("%w: %d bytes, at most %d", ErrInvalidRegion, len(s.Region), MaxRegionLength))
+	}
+	// SRV records carry both as 16-bit values
+	if s.Weight < 0 || s.Weight > 65535 || s.Priority < 0 || s.Priority > 65535 {
+		return invalid(s, ErrInvalidWeight)
+	}
+	if p := s.protocol(); p != ProtocolTCP && p != ProtocolUDP {
+		return invalid(s, ErrInvalidProtocol)
+	}
+	for _, key := range reservedTags {
+		if _, ok := s.Tags[key]; ok {
+			return invalid(s, fmt.Errorf("%w %q", ErrReservedTag, key))
+		}
 	}
 
 	return nil
 }
 
+// validateName checks that name can be used as a service's key segment.
+func validateName(name string) error {
+	if name == "" {
+		return ErrMissingName
+	}
+	// the name becomes a key segment, and ':' separates protocol and port
+	if strings.ContainsAny(name, "/:") {
+		return fmt.Errorf("%w: may not contain '/' or ':'", ErrInvalidName)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: may not contain control characters: %q", ErrInvalidName, name)
+	}
+
+	return nil
+}
+
+// returns the service's protocol, defaulting to tcp
+func (s *Service) protocol() string {
+	if s.Protocol == "" {
+		return ProtocolTCP
+	}
+	return s.Protocol
+}
+
+// String formats s compactly as name:port, with the protocol after the port
+// if set and the hostname after an @ if known, e.g. dns:53/udp@host1.
+func (s *Service) String() string {
+	if s == nil {
+		return "<nil>"
+	}
+
+	str := fmt.Sprintf("%s:%d", s.Name, s.Port)
+	if s.Protocol != "" {
+		str += "/" + s.Protocol
+	}
+	if s.Hostname != "" {
+		str += "@" + s.Hostname
+	}
+	return str
+}
+
+// Equal reports whether s and other describe the same registration: the
+// same Name, Port, Protocol and Hostname. Tags are not compared.
+func (s *Service) Equal(other *Service) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	return s.id() == other.id()
+}
+
+// Clone returns a deep copy of s, including its Tags, that can be changed
+// without affecting s.
+func (s *Service) Clone() *Service {
+	if s == nil {
+		return nil
+	}
+
+	copied := *s
+	if s.Tags != nil {
+		copied.Tags = make(map[string]string, len(s.Tags))
+		for k, v := range s.Tags {
+			copied.Tags[k] = v
+		}
+	}
+	return &copied
+}
+
+// serviceID holds the fields Equal compares, for use as a map key.
+type serviceID struct {
+	name     string
+	port     int
+	protocol string
+	hostname string
+}
+
+func (s *Service) id() serviceID {
+	return serviceID{s.Name, s.Port, s.protocol(), s.Hostname}
+}
+
 // returns the complete path of the service in etcd
 func (s *Service) path() string {
-	return fmt.Sprintf("%s/%s:%d", RegistryPath, s.Name, s.Port)
+	return s.pathIn(RegistryPath)
+}
+
+// returns the path of the service below the registry root prefix
+func (s *Service) pathIn(prefix string) string {
+	return fmt.Sprintf("%s/%s/%s:%d", prefix, s.Name, s.protocol(), s.Port)
 }
 
 // Marshal a service object to a byte array.
@@ -79,6 +432,48 @@ func (s *Service) Marshal() ([]byte, error) {
 	return bytes, nil
 }
 
+// UnmarshalJSON decodes a Service, defaulting Protocol to tcp and
+// SchemaVersion to 1 and rejecting a port outside 1-65535. A missing port is
+// left at zero, since a partial entry can still be completed from its etcd
+// key.
+func (s *Service) UnmarshalJSON(bytes []byte) error {
+	// plain has Service's fields without this method, so decoding it can't recurse
+	type plain Service
+	aux := struct {
+		*plain
+		Port *int `json:"port"`
+	}{plain: (*plain)(s)}
+
+	if err := json.Unmarshal(bytes, &aux); err != nil {
+		return err
+	}
+
+	if aux.Port != nil {
+		if *aux.Port < 1 || *aux.Port > 65535 {
+			copied := *s
+			copied.Port = *aux.Port
+			return invalid(&copied, ErrInvalidPort)
+		}
+		s.Port = *aux.Port
+	}
+
+	// entries written before Protocol existed are tcp
+	s.Protocol = s.protocol()
+
+	// and those written before versioning are version 1
+	if s.SchemaVersion == 0 {
+		s.SchemaVersion = 1
+	} else if s.SchemaVersion > CurrentSchemaVersion {
+		logger().Warn("Service entry uses a newer schema. Unknown fields are ignored", Fields{
+			"service": s.Name,
+			"port":    s.Port,
+			"schema":  s.SchemaVersion,
+		})
+	}
+
+	return nil
+}
+
 // UnmarshalService deserializes a Service object from a byte array.
 func UnmarshalService(bytes []byte) (*Service, error) {
 	s := &Service{}
@@ -90,209 +485,432 @@ func UnmarshalService(bytes []byte) (*Service, error) {
 	return s, nil
 }
 
-// Unregister a (service, port) tuple.
+// MarshalServices serializes services as a single JSON array. A nil slice
+// becomes an empty array.
+func MarshalServices(services []*Service) ([]byte, error) {
+	if services == nil {
+		services = []*Service{}
+	}
+	return json.Marshal(services)
+}
+
+// UnmarshalServices deserializes a JSON array written by MarshalServices.
+func UnmarshalServices(bytes []byte) ([]*Service, error) {
+	services := []*Service{}
+	if err := json.Unmarshal(bytes, &services); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// Unregister a (service, port) tuple. A tuple that isn't registered is not an
+// error, so cleanup can safely run more than once.
 func Unregister(name string, port int) error {
-	// service doesn't have a name or has an invalid port
-	svc := &Service{name, port, os.Getenv("HOSTNAME")}
-	if err := svc.validate(); err != nil {
-		log.WithFields(log.Fields{
-			"action":  "Validate",
-			"service": name,
-			"port":    svc.Port,
-			"errstr":  err.Error(),
-		}).Error("Service Validation Failed.")
+	return UnregisterContext(context.Background(), name, port)
+}
+
+// UnregisterContext unregisters a (service, port) tuple, giving up as soon as
+// ctx is done.
+func UnregisterContext(ctx context.Context, name string, port int) error {
+	r, err := defaultRegistry()
+	if err != nil {
 		return err
 	}
 
-	// initialize a new etcd client
-	c, err := client.New(cfg)
+	return r.UnregisterContext(ctx, name, port)
+}
+
+// UnregisterInstance deletes exactly the key svc is stored at, protocol
+// included.
+func UnregisterInstance(svc *Service) error {
+	r, err := defaultRegistry()
 	if err != nil {
-		log.WithFields(log.Fields{"service": "portmapper", "errstr": err.Error()}).Fatal("Error initializing etcd client")
-		panic(err)
+		return err
 	}
 
-	kAPI := client.NewKeysAPI(c)
+	return r.UnregisterInstance(svc)
+}
 
-	// attempt to delete the svc's path with exponential backoff
-	for try := 0; try < MaxRetries; try++ {
-		// 5 second context
-		ctx, cancel := context.WithTimeout(context.Background(), RequestTimeoutSec*time.Second)
-		defer cancel()
+// UnregisterService removes every registration of the named service and
+// returns how many there were.
+func UnregisterService(name string) (int, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return 0, err
+	}
 
-		_, err = kAPI.Delete(ctx, svc.path(), nil)
-		if err != nil {
-			// handle error
-			if err == context.DeadlineExceeded {
-				log.WithFields(log.Fields{
-					"action":  "Validate",
-					"service": name,
-					"port":    svc.Port,
-					"attempt": try,
-					"errstr":  err.Error(),
-				}).Warn("Service path deletion exceeded context deadline. Retrying")
-			} else {
-				log.WithFields(log.Fields{
-					"action":  "Validate",
-					"service": name,
-					"port":    svc.Port,
-					"errstr":  err.Error(),
-				}).Error("Service path deletion failed.")
-				return err
-			}
-		} else {
-			log.WithFields(log.Fields{
-				"action":  "set",
-				"service": name,
-				"port":    svc.Port,
-				"path":    svc.path(),
-			}).Info("Successfully unregistered service with etcd")
-			break
-		}
+	return r.UnregisterService(name)
+}
 
-		time.Sleep(2 << uint(try) * time.Millisecond)
+// DeregisterStale deletes every registered service for which live returns
+// false and returns how many were deleted.
+func DeregisterStale(ctx context.Context, live func(*Service) bool) (int, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	return r.DeregisterStale(ctx, live)
+}
+
+// Reregister writes every service registered through the default registry
+// back to etcd.
+func Reregister() error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.Reregister()
+}
+
+// RegisterAll registers several services, writing nothing if any of them is
+// invalid.
+func RegisterAll(services []*Service) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.RegisterAll(services)
+}
+
+// RegisterPorts registers a service on several ports, all or none.
+func RegisterPorts(name string, ports []int) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.RegisterPorts(name, ports)
+}
+
+// UnregisterAll unregisters several services, deleting nothing if any of
+// them is invalid.
+func UnregisterAll(services []*Service) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.UnregisterAll(services)
 }
 
 // Register a service with etcd
 func Register(name string, port int) error {
-	svc := &Service{name, port, os.Getenv("HOSTNAME")}
-
-	if err := svc.validate(); err != nil {
-		log.WithFields(log.Fields{
-			"action":  "Validate",
-			"service": name,
-			"port":    svc.Port,
-			"errstr":  err.Error(),
-		}).Error("Service Validation Failed.")
+	return RegisterContext(context.Background(), name, port)
+}
+
+// RegisterContext registers a service with etcd, giving up as soon as ctx is
+// done.
+func RegisterContext(ctx context.Context, name string, port int) error {
+	r, err := defaultRegistry()
+	if err != nil {
 		return err
 	}
 
-	bytes, err := svc.Marshal()
+	return r.RegisterContext(ctx, name, port)
+}
+
+// RegisterExclusive registers a service only if no other instance holds its
+// key, returning an error wrapping ErrAlreadyRegistered otherwise.
+func RegisterExclusive(name string, port int) error {
+	r, err := defaultRegistry()
 	if err != nil {
-		log.WithFields(log.Fields{
-			"action":  "Marshall",
-			"service": name,
-			"port":    svc.Port,
-			"errstr":  err.Error(),
-		}).Error("Marshalling Failed.")
 		return err
 	}
 
-	// initialize a new etcd client
-	c, err := client.New(cfg)
+	return r.RegisterExclusive(name, port)
+}
+
+// RegisterWithHostname registers a service under an explicit hostname.
+func RegisterWithHostname(name string, port int, hostname string) error {
+	r, err := defaultRegistry()
 	if err != nil {
-		log.WithFields(log.Fields{"service": "portmapper", "errstr": err.Error()}).Fatal("Error initializing etcd client")
-		panic(err)
+		return err
 	}
 
-	kAPI := client.NewKeysAPI(c)
+	return r.RegisterWithHostname(name, port, hostname)
+}
 
-	// attempt to delete the svc's path with exponential backoff
-	for try := 0; try < MaxRetries; try++ {
-		// 5 second context
-		ctx, cancel := context.WithTimeout(context.Background(), RequestTimeoutSec*time.Second)
-		defer cancel()
+// RegisterWithAddress registers a service that consumers should reach at the
+// IP address.
+func RegisterWithAddress(name string, port int, address string) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
 
-		_, err := kAPI.Set(ctx, svc.path(), string(bytes), nil)
-		if err != nil {
-			// handle error
-			if err == context.DeadlineExceeded {
-				log.WithFields(log.Fields{
-					"action":  "Register",
-					"service": name,
-					"port":    svc.Port,
-					"attempt": try,
-					"errstr":  err.Error(),
-				}).Warn("Service registration exceeded context deadline. Retrying")
-			} else {
-				log.WithFields(log.Fields{
-					"action":  "Register",
-					"service": name,
-					"port":    svc.Port,
-					"errstr":  err.Error(),
-				}).Error("Service registration failed.")
-				return err
-			}
-		} else {
-			log.WithFields(log.Fields{
-				"action":  "set",
-				"service": name,
-				"port":    svc.Port,
-				"path":    svc.path(),
-			}).Info("Successfully registered service with etcd")
-			break
-		}
+	return r.RegisterWithAddress(name, port, address)
+}
+
+// RegisterWithTags registers a service labelled with tags.
+func RegisterWithTags(name string, port int, tags map[string]string) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
 
-		time.Sleep(2 << uint(try) * time.Millisecond)
+	return r.RegisterWithTags(name, port, tags)
+}
+
+// RegisterWeighted registers a service with a load-balancing weight and
+// priority.
+func RegisterWeighted(name string, port, weight, priority int) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return r.RegisterWeighted(name, port, weight, priority)
+}
+
+// RegisterURL registers a service at rawurl, such as "grpc://10.0.0.1:9090".
+func RegisterURL(name, rawurl string) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.RegisterURL(name, rawurl)
+}
+
+// RegisterWithRegion registers a service in region rather than the one from
+// the environment.
+func RegisterWithRegion(name string, port int, region string) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.RegisterWithRegion(name, port, region)
+}
+
+// RegisterTTL registers a service whose key expires after ttl unless it is
+// registered again before then.
+func RegisterTTL(name string, port int, ttl time.Duration) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.RegisterTTL(name, port, ttl)
+}
+
+// Drain marks the registration of (name, port) as Draining ahead of
+// unregistering it.
+func Drain(name string, port int) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.Drain(name, port)
+}
+
+// Refresh rewrites an existing registration with svc's current value.
+func Refresh(svc *Service) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.Refresh(svc)
+}
+
+// RegisterWithKeepAlive registers a service with a TTL and refreshes it in
+// the background until ctx is done, when the key is deleted.
+func RegisterWithKeepAlive(ctx context.Context, name string, port int, ttl time.Duration) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.RegisterWithKeepAlive(ctx, name, port, ttl)
+}
+
+// RegisterAndAutoUnregister registers a service and returns a cleanup func
+// that unregisters it, which also runs once ctx is done.
+func RegisterAndAutoUnregister(ctx context.Context, name string, port int) (func(), error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.RegisterAndAutoUnregister(ctx, name, port)
 }
 
 // Services returns an array of Service pointers detailing the service name and
 // port of each registered service. (from etcd)
 func Services() ([]*Service, error) {
-	// initialize a new etcd client
-	c, err := client.New(cfg)
+	return ServicesContext(context.Background())
+}
+
+// ServicesContext is like Services but gives up as soon as ctx is done.
+func ServicesContext(ctx context.Context) ([]*Service, error) {
+	r, err := defaultRegistry()
 	if err != nil {
-		log.WithFields(log.Fields{"service": "portmapper", "errstr": err.Error()}).Fatal("Error initializing etcd client")
 		return nil, err
 	}
 
-	kAPI := client.NewKeysAPI(c)
+	return r.ServicesContext(ctx)
+}
 
-	// attempt to delete the svc's path with exponential backoff
-	for try := 0; try < MaxRetries; try++ {
-		// 5 second context
-		ctx, cancel := context.WithTimeout(context.Background(), RequestTimeoutSec*time.Second)
-		defer cancel()
+// ServicesCached is like Services but reuses a result for up to
+// DefaultCacheTTL.
+func ServicesCached() ([]*Service, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return nil, err
+	}
 
-		resp, err := kAPI.Get(ctx, RegistryPath, &client.GetOptions{Sort: true})
-		if err != nil {
-			// handle error
-			if err == context.DeadlineExceeded {
-				log.WithFields(log.Fields{
-					"action":  "Enumerate Services",
-					"attempt": try,
-					"errstr":  err.Error(),
-				}).Warn("Service enumeration exceeded context deadline. Retrying")
-			} else {
-				log.WithFields(log.Fields{
-					"action":  "Enumerate Services",
-					"attempt": try,
-					"errstr":  err.Error(),
-				}).Error("Service enumeration failed")
-				return nil, err
-			}
-		} else if resp == nil {
-			log.WithFields(log.Fields{
-				"action":  "Enumerate Services",
-				"attempt": try,
-				"errstr":  "nil response for etcd get",
-			}).Error("Service enumeration failed")
-			return nil, errors.New("Nil response from  etcd get")
-		} else {
-			svcNodes := resp.Node.Nodes
-			services := make([]*Service, len(svcNodes))
-
-			for i, node := range svcNodes {
-				svcStr := node.Value
-				svc, err := UnmarshalService([]byte(svcStr))
-
-				if err != nil {
-					return nil, err
-				}
-
-				services[i] = svc
-			}
-
-			return services, nil
-		}
+	return r.ServicesCached()
+}
+
+// InvalidateCache drops the result held for ServicesCached.
+func InvalidateCache() {
+	defaultMu.Lock()
+	r := defaultReg
+	defaultMu.Unlock()
+
+	if r != nil {
+		r.InvalidateCache()
+	}
+}
+
+// ServicesStream delivers registered services one at a time as they are
+// decoded.
+func ServicesStream(ctx context.Context) (<-chan *Service, <-chan error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		services := make(chan *Service)
+		errs := make(chan error, 1)
+		errs <- err
+		close(services)
+		close(errs)
+		return services, errs
+	}
+
+	return r.ServicesStream(ctx)
+}
+
+// GetService returns every registered instance of the named service.
+func GetService(name string) ([]*Service, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetService(name)
+}
+
+// GetServiceByPort returns the service registered from this host on port.
+func GetServiceByPort(port int) (*Service, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetServiceByPort(port)
+}
+
+// ServicesMap returns the registered services grouped by Name.
+func ServicesMap() (map[string][]*Service, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return nil, err
+	}
 
-		time.Sleep(2 << uint(try) * time.Millisecond)
+	return r.ServicesMap()
+}
+
+// RegistryStats counts the registered services by name and host.
+func RegistryStats() (Stats, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	return r.RegistryStats()
+}
+
+// ServiceNames returns the sorted distinct names of the registered services.
+func ServiceNames() ([]string, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.ServiceNames()
+}
+
+// ServicesByHostname returns the services registered from hostname.
+func ServicesByHostname(hostname string) ([]*Service, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.ServicesByHostname(hostname)
+}
+
+// ServicesByTag returns the services tagged with key set to value.
+func ServicesByTag(key, value string) ([]*Service, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.ServicesByTag(key, value)
+}
+
+// Count returns how many service entries are registered.
+func Count() (int, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return 0, err
+	}
+
+	return r.Count()
+}
+
+// Watch streams changes to the registry until ctx is done.
+func Watch(ctx context.Context) (<-chan ServiceEvent, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Watch(ctx)
+}
+
+// Ping reports whether etcd is reachable, for use as a readiness probe.
+func Ping(ctx context.Context) error {
+	r, err := defaultRegistry()
+	if err != nil {
+		return err
+	}
+
+	return r.Ping(ctx)
+}
+
+// WatchService streams changes to the named service until ctx is done.
+func WatchService(ctx context.Context, name string) (<-chan ServiceEvent, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.WatchService(ctx, name)
+}
+
+// IsRegistered reports whether a tcp service is registered on name and port.
+func IsRegistered(name string, port int) (bool, error) {
+	r, err := defaultRegistry()
+	if err != nil {
+		return false, err
 	}
 
-	return nil, errors.New("Couldn't get services from etcd")
+	return r.IsRegistered(name, port)
 }
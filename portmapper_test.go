@@ -1,8 +1,16 @@
 package portmapper
 
 import (
-	"github.com/stretchr/testify/assert"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -25,9 +33,9 @@ func Test_RegisterValidServices(t *testing.T) {
 	// register these validservices
 	for i := 0; i < len(validservices); i++ {
 		if Register(validservices[i].Name, validservices[i].Port) != nil {
-			t.Error("error registering %s on port %v", validservices[i].Name, validservices[i].Port)
+			t.Errorf("error registering %s on port %v", validservices[i].Name, validservices[i].Port)
 		} else {
-			t.Log("successfully registered %s on port %v", validservices[i].Name, validservices[i].Port)
+			t.Logf("successfully registered %s on port %v", validservices[i].Name, validservices[i].Port)
 		}
 	}
 
@@ -37,16 +45,16 @@ func Test_RegisterValidServices(t *testing.T) {
 			assert.Equal(t, len(validservices), len(resultantservices))
 
 			for i := 0; i < len(resultantservices); i++ {
-				t.Log("Found service %s on port %v", resultantservices[i].Name, resultantservices[i].Port)
+				t.Logf("Found service %s on port %v", resultantservices[i].Name, resultantservices[i].Port)
 
 				assert.Equal(t, resultantservices[i].Name, validservices[i].Name)
 				assert.Equal(t, resultantservices[i].Port, validservices[i].Port)
 			}
 		} else {
-			t.Log("Bad news.  Retrieved services list is nil")
+			t.Logf("Bad news.  Retrieved services list is nil")
 		}
 	} else {
-		t.Error("Error retrieving services: %s", err)
+		t.Errorf("Error retrieving services: %s", err)
 	}
 
 }
@@ -55,9 +63,9 @@ func Test_UnregisterValidServices(t *testing.T) {
 	// register these validservices
 	for i := 0; i < len(validservices); i++ {
 		if Unregister(validservices[i].Name, validservices[i].Port) != nil {
-			t.Error("error unregistering %s on port %v", validservices[i].Name, validservices[i].Port)
+			t.Errorf("error unregistering %s on port %v", validservices[i].Name, validservices[i].Port)
 		} else {
-			t.Log("successfully unregistered %s on port %v", validservices[i].Name, validservices[i].Port)
+			t.Logf("successfully unregistered %s on port %v", validservices[i].Name, validservices[i].Port)
 		}
 	}
 }
@@ -66,9 +74,639 @@ func Test_RegisterInvalidServices(t *testing.T) {
 	// register these validservices
 	for i := 0; i < len(invalidservices); i++ {
 		if Register(invalidservices[i].Name, invalidservices[i].Port) != nil {
-			t.Log("error registering INVALID SERVICE %s on port %v", invalidservices[i].Name, invalidservices[i].Port)
+			t.Logf("error registering INVALID SERVICE %s on port %v", invalidservices[i].Name, invalidservices[i].Port)
+		} else {
+			t.Errorf("successfully registered INVALID SERVICE %s on port %v", invalidservices[i].Name, invalidservices[i].Port)
+		}
+	}
+}
+
+func Test_ServicesReturnsAfterFirstSuccess(t *testing.T) {
+	kapi := &fakeKeysAPI{
+		get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+			return &client.Response{Node: &client.Node{Nodes: client.Nodes{
+				&client.Node{Key: RegistryPath + "/serviceA:1", Value: `{"name":"serviceA","port":1}`},
+			}}}, nil
+		},
+	}
+	defer useKeysAPI(kapi)()
+
+	services, err := Services()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kapi.gets)
+	assert.Equal(t, 1, len(services))
+}
+
+func Test_ServicesEmptyRegistry(t *testing.T) {
+	kapi := &fakeKeysAPI{
+		get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+			return nil, client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key}
+		},
+	}
+	defer useKeysAPI(kapi)()
+
+	services, err := Services()
+	assert.NoError(t, err)
+	assert.NotNil(t, services)
+	assert.Equal(t, 0, len(services))
+}
+
+func Test_ClientInitFailureDoesNotPanic(t *testing.T) {
+	defer useConfig(client.Config{Transport: client.DefaultTransport})()
+
+	assert.NotPanics(t, func() {
+		assert.Error(t, Register("serviceA", 1))
+		assert.Error(t, Unregister("serviceA", 1))
+		_, err := Services()
+		assert.Error(t, err)
+	})
+}
+
+func Test_DefaultRegistryConcurrentInit(t *testing.T) {
+	defer useConfig(client.Config{Endpoints: []string{EtcdHost}, Transport: client.DefaultTransport})()
+
+	// concurrent first callers all get the one registry
+	first := func(setters ...func()) []*Registry {
+		var wg sync.WaitGroup
+		regs := make([]*Registry, 20)
+		for i := range regs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r, err := defaultRegistry()
+				assert.NoError(t, err)
+				regs[i] = r
+			}(i)
+		}
+		for _, set := range setters {
+			wg.Add(1)
+			go func(set func()) {
+				defer wg.Done()
+				set()
+			}(set)
+		}
+		wg.Wait()
+		return regs
+	}
+	regs := first()
+	for _, r := range regs {
+		assert.True(t, r == regs[0])
+	}
+
+	// setters may replace it, but don't race with it
+	defaultReg = nil
+	for _, r := range first(func() { SetHeaderTimeout(2 * time.Second) }, func() { SetDialTimeout(time.Second) }) {
+		assert.NotNil(t, r)
+	}
+	assert.Equal(t, 2*time.Second, cfg.HeaderTimeoutPerRequest)
+}
+
+func Test_ConcurrentRegister(t *testing.T) {
+	defer useKeysAPI(NewMemoryBackend())()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			assert.NoError(t, Register("serviceA", port))
+			_, err := Services()
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	n, err := Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 20, n)
+}
+
+func Test_NoEndpointsConfigured(t *testing.T) {
+	for _, endpoints := range [][]string{nil, {""}, {" ", ""}} {
+		func() {
+			defer useConfig(client.Config{Endpoints: endpoints, Transport: client.DefaultTransport})()
+
+			assert.ErrorIs(t, Register("serviceA", 1), ErrNoEndpoints)
+			assert.ErrorIs(t, Unregister("serviceA", 1), ErrNoEndpoints)
+			_, err := Services()
+			assert.ErrorIs(t, err, ErrNoEndpoints)
+		}()
+	}
+
+	// an unset ETCD_HOST falls back to the default rather than to nothing
+	assert.NoError(t, checkEndpoints(ParseEndpoints("")))
+}
+
+func Test_UnreachableEndpointDoesNotPanic(t *testing.T) {
+	defer useConfig(client.Config{
+		Endpoints:               []string{"http://127.0.0.1:1"},
+		Transport:               client.DefaultTransport,
+		HeaderTimeoutPerRequest: time.Second,
+	})()
+
+	assert.NotPanics(t, func() {
+		assert.Error(t, Register("serviceA", 1))
+		assert.Error(t, Unregister("serviceA", 1))
+		_, err := Services()
+		assert.Error(t, err)
+	})
+}
+
+func Test_ContextCancelledMidRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	timeout := func() error {
+		cancel()
+		return context.DeadlineExceeded
+	}
+	kapi := &fakeKeysAPI{
+		get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+			return nil, timeout()
+		},
+		set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+			return nil, timeout()
+		},
+		delete: func(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+			return nil, timeout()
+		},
+	}
+	defer useKeysAPI(kapi)()
+
+	assert.Equal(t, context.Canceled, RegisterContext(ctx, "serviceA", 1))
+	assert.Equal(t, 1, kapi.sets)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	assert.Equal(t, context.Canceled, UnregisterContext(ctx, "serviceA", 1))
+	assert.Equal(t, 1, kapi.deletes)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	_, err := ServicesContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, kapi.gets)
+}
+
+func Test_BackoffAbortsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	assert.Equal(t, context.Canceled, backoff(ctx, time.Hour))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func Test_SetEndpoints(t *testing.T) {
+	defer useConfig(cfg)()
+
+	endpoints := []string{"http://10.0.0.1:2379", "http://10.0.0.2:2379"}
+	SetEndpoints(endpoints)
+
+	c, err := newClient()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, endpoints, c.Endpoints())
+}
+
+func Test_ParseEndpoints(t *testing.T) {
+	assert.Equal(t, []string{"http://10.0.0.1:2379"}, ParseEndpoints("http://10.0.0.1:2379"))
+	assert.Equal(t, []string{"http://10.0.0.1:2379", "http://10.0.0.2:2379", "http://10.0.0.3:2379"},
+		ParseEndpoints(" http://10.0.0.1:2379, http://10.0.0.2:2379,,\thttp://10.0.0.3:2379 "))
+	assert.Equal(t, []string{EtcdHost}, ParseEndpoints(""))
+	assert.Equal(t, []string{EtcdHost}, ParseEndpoints(" , "))
+}
+
+func Test_SetCredentials(t *testing.T) {
+	defer useConfig(cfg)()
+
+	before := cfg
+	SetCredentials("", "")
+	assert.Equal(t, before, cfg)
+
+	SetCredentials("root", "hunter2")
+	assert.Equal(t, "root", cfg.Username)
+	assert.Equal(t, "hunter2", cfg.Password)
+}
+
+func Test_SetHeaderTimeout(t *testing.T) {
+	defer useConfig(cfg)()
+	assert.Equal(t, DefaultHeaderTimeout, cfg.HeaderTimeoutPerRequest)
+
+	defaultReg = &Registry{}
+	SetHeaderTimeout(5 * time.Second)
+	assert.Equal(t, 5*time.Second, cfg.HeaderTimeoutPerRequest)
+	assert.Nil(t, defaultReg)
+
+	SetHeaderTimeout(0)
+	assert.Equal(t, DefaultHeaderTimeout, cfg.HeaderTimeoutPerRequest)
+}
+
+func Test_ServiceProtocolPath(t *testing.T) {
+	assert.Equal(t, RegistryPath+"/serviceA/tcp:53", (&Service{Name: "serviceA", Port: 53}).path())
+	assert.Equal(t, RegistryPath+"/serviceA/tcp:53", (&Service{Name: "serviceA", Port: 53, Protocol: ProtocolTCP}).path())
+	assert.Equal(t, RegistryPath+"/serviceA/udp:53", (&Service{Name: "serviceA", Port: 53, Protocol: ProtocolUDP}).path())
+}
+
+func Test_ServiceProtocolValidation(t *testing.T) {
+	assert.NoError(t, (&Service{Name: "serviceA", Port: 53}).Validate())
+	assert.NoError(t, (&Service{Name: "serviceA", Port: 53, Protocol: ProtocolUDP}).Validate())
+	assert.Error(t, (&Service{Name: "serviceA", Port: 53, Protocol: "sctp"}).Validate())
+	assert.Error(t, (&Service{Name: "serviceA", Port: 53, Protocol: "TCP"}).Validate())
+}
+
+func Test_ServiceProtocolMarshalling(t *testing.T) {
+	bytes, err := (&Service{Name: "serviceA", Port: 53}).Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name":"serviceA","port":53}`, string(bytes))
+
+	svc, err := UnmarshalService(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolTCP, svc.Protocol)
+
+	udp := &Service{Name: "serviceA", Port: 53, Protocol: ProtocolUDP, SchemaVersion: 1}
+	bytes, err = udp.Marshal()
+	assert.NoError(t, err)
+	svc, err = UnmarshalService(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, udp, svc)
+}
+
+func Test_ServiceWeightMarshalling(t *testing.T) {
+	bytes, err := (&Service{Name: "serviceA", Port: 1}).Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name":"serviceA","port":1}`, string(bytes))
+
+	weighted := &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Weight: 10, Priority: 2, SchemaVersion: 1}
+	bytes, err = weighted.Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name":"serviceA","port":1,"protocol":"tcp","weight":10,"priority":2,"schema":1}`, string(bytes))
+
+	svc, err := UnmarshalService(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, weighted, svc)
+
+	// the key doesn't change with weight or priority
+	assert.Equal(t, (&Service{Name: "serviceA", Port: 1}).path(), weighted.path())
+}
+
+func Test_ServiceWeightValidation(t *testing.T) {
+	assert.NoError(t, (&Service{Name: "serviceA", Port: 1, Weight: 65535, Priority: 65535}).Validate())
+	assert.ErrorIs(t, (&Service{Name: "serviceA", Port: 1, Weight: -1}).Validate(), ErrInvalidWeight)
+	assert.ErrorIs(t, (&Service{Name: "serviceA", Port: 1, Priority: -1}).Validate(), ErrInvalidWeight)
+	assert.ErrorIs(t, (&Service{Name: "serviceA", Port: 1, Weight: 65536}).Validate(), ErrInvalidWeight)
+
+	r := NewInMemoryRegistry()
+	assert.NoError(t, r.RegisterWeighted("serviceA", 1, 10, 2))
+	assert.ErrorIs(t, r.RegisterWeighted("serviceB", 1, -1, 0), ErrInvalidWeight)
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 1) {
+		assert.Equal(t, 10, services[0].Weight)
+		assert.Equal(t, 2, services[0].Priority)
+	}
+}
+
+func Test_ServiceRegion(t *testing.T) {
+	t.Setenv("POMAPPER_REGION", "")
+	t.Setenv("AWS_REGION", "us-west-2")
+	backend := NewMemoryBackend()
+	r := NewRegistry(backend)
+
+	assert.NoError(t, r.Register("serviceA", 1))
+	t.Setenv("POMAPPER_REGION", "dc1")
+	assert.NoError(t, r.Register("serviceB", 2))
+	assert.NoError(t, r.RegisterWithRegion("serviceC", 3, "eu-west-1"))
+	assert.Contains(t, backend.entries[RegistryPath+"/serviceC/tcp:3"].value, `"region":"eu-west-1"`)
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 3) {
+		assert.Equal(t, "us-west-2", services[0].Region)
+		assert.Equal(t, "dc1", services[1].Region)
+		assert.Equal(t, "eu-west-1", services[2].Region)
+	}
+
+	// only the length is checked
+	assert.ErrorIs(t, r.RegisterWithRegion("serviceD", 4, strings.Repeat("x", MaxRegionLength+1)), ErrInvalidRegion)
+
+	t.Setenv("POMAPPER_REGION", "")
+	t.Setenv("AWS_REGION", "")
+	bytes, err := (&Service{Name: "serviceA", Port: 1}).Marshal()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(bytes), "region")
+}
+
+func Test_RegisterURL(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	t.Setenv("POMAPPER_REGION", "")
+	t.Setenv("AWS_REGION", "")
+	r := NewInMemoryRegistry()
+
+	assert.NoError(t, r.RegisterURL("serviceA", "https://10.0.0.1:8443/api"))
+	assert.NoError(t, r.RegisterURL("serviceB", "grpc://[::1]:9090"))
+	assert.NoError(t, r.RegisterURL("serviceC", "http://api.example.com:8080"))
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Service{
+		{Name: "serviceA", Port: 8443, Protocol: ProtocolTCP, Hostname: "host1", Address: "10.0.0.1", URL: "https://10.0.0.1:8443/api", SchemaVersion: 1, ModifiedIndex: 1},
+		{Name: "serviceB", Port: 9090, Protocol: ProtocolTCP, Hostname: "host1", Address: "::1", URL: "grpc://[::1]:9090", SchemaVersion: 1, ModifiedIndex: 2},
+		{Name: "serviceC", Port: 8080, Protocol: ProtocolTCP, Hostname: "host1", URL: "http://api.example.com:8080", SchemaVersion: 1, ModifiedIndex: 3},
+	}, services)
+
+	for _, bad := range []string{
+		"",
+		"10.0.0.1:80",
+		"http://10.0.0.1",
+		"http://:80",
+		"http://10.0.0.1:0",
+		"http://10.0.0.1:65536",
+		"http://10.0.0.1:http",
+		"http://[::1:80",
+	} {
+		assert.ErrorIs(t, r.RegisterURL("serviceD", bad), ErrInvalidURL, bad)
+	}
+	count, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// a URL set by hand has to agree with Port
+	assert.ErrorIs(t, (&Service{Name: "serviceA", Port: 80, URL: "http://host1:8080"}).Validate(), ErrInvalidURL)
+	assert.NoError(t, (&Service{Name: "serviceA", Port: 8080, URL: "http://host1:8080"}).Validate())
+	// and a bad Port is reported as such, not as a URL mismatch
+	assert.ErrorIs(t, (&Service{Name: "serviceA", URL: "http://host1:8080"}).Validate(), ErrInvalidPort)
+}
+
+func Test_ServiceTagsMarshalling(t *testing.T) {
+	tagged := &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Tags: map[string]string{"env": "prod", "version": "1.2"}, SchemaVersion: 1}
+	bytes, err := tagged.Marshal()
+	assert.NoError(t, err)
+	svc, err := UnmarshalService(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, tagged, svc)
+
+	bytes, err = (&Service{Name: "serviceA", Port: 1, Tags: map[string]string{}}).Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name":"serviceA","port":1}`, string(bytes))
+}
+
+func Test_ServiceReservedTags(t *testing.T) {
+	assert.NoError(t, (&Service{Name: "serviceA", Port: 1, Tags: map[string]string{"env": "prod"}}).Validate())
+	assert.Error(t, (&Service{Name: "serviceA", Port: 1, Tags: map[string]string{"name": "serviceB"}}).Validate())
+	assert.Error(t, (&Service{Name: "serviceA", Port: 1, Tags: map[string]string{"port": "2"}}).Validate())
+}
+
+func Test_ServiceEqual(t *testing.T) {
+	a := &Service{Name: "serviceA", Port: 1, Hostname: "host1"}
+	assert.True(t, a.Equal(&Service{Name: "serviceA", Port: 1, Hostname: "host1"}))
+	assert.True(t, a.Equal(&Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "host1"}))
+	assert.True(t, a.Equal(&Service{Name: "serviceA", Port: 1, Hostname: "host1", Tags: map[string]string{"env": "prod"}}))
+
+	assert.False(t, a.Equal(&Service{Name: "serviceA", Port: 1, Hostname: "host2"}))
+	assert.False(t, a.Equal(&Service{Name: "serviceA", Port: 1}))
+	assert.False(t, a.Equal(&Service{Name: "serviceA", Port: 2, Hostname: "host1"}))
+	assert.False(t, a.Equal(&Service{Name: "serviceB", Port: 1, Hostname: "host1"}))
+	assert.False(t, a.Equal(&Service{Name: "serviceA", Port: 1, Protocol: ProtocolUDP, Hostname: "host1"}))
+	assert.False(t, a.Equal(nil))
+	assert.True(t, (*Service)(nil).Equal(nil))
+}
+
+func Test_ServiceClone(t *testing.T) {
+	svc := &Service{Name: "serviceA", Port: 1, Hostname: "host1", Weight: 5, Tags: map[string]string{"env": "prod"}}
+	clone := svc.Clone()
+	assert.Equal(t, svc, clone)
+
+	clone.Tags["env"] = "staging"
+	clone.Tags["canary"] = "true"
+	clone.Port = 2
+	assert.Equal(t, map[string]string{"env": "prod"}, svc.Tags)
+	assert.Equal(t, 1, svc.Port)
+
+	assert.Nil(t, (&Service{Name: "serviceA", Port: 1}).Clone().Tags)
+	assert.Nil(t, (*Service)(nil).Clone())
+}
+
+func Test_ServiceHostnameValidation(t *testing.T) {
+	svc := &Service{Name: "serviceA", Port: 1, Hostname: "  host1\n"}
+	assert.NoError(t, svc.Validate())
+	assert.Equal(t, "  host1\n", svc.Hostname)
+
+	// registering trims it, on a copy
+	r := NewInMemoryRegistry()
+	assert.NoError(t, r.RegisterAll([]*Service{svc}))
+	assert.Equal(t, "  host1\n", svc.Hostname)
+	services, err := r.Services()
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, "host1", services[0].Hostname)
+	}
+
+	for _, hostname := range []string{"host/1", "host:1", "/", ":"} {
+		assert.Error(t, (&Service{Name: "serviceA", Port: 1, Hostname: hostname}).Validate(), hostname)
+	}
+}
+
+func Test_ServiceNameValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"serviceA", true},
+		{"service-a.v2_b", true},
+		{"foo/bar", false},
+		{"/foo", false},
+		{"foo:8080", false},
+		{"foo\nbar", false},
+		{"foo\tbar", false},
+		{"foo\x00", false},
+		{"foo\x7f", false},
+	}
+
+	for _, test := range tests {
+		err := (&Service{Name: test.name, Port: 1}).Validate()
+		if test.valid {
+			assert.NoError(t, err, "%q", test.name)
 		} else {
-			t.Error("successfully registered INVALID SERVICE %s on port %v", invalidservices[i].Name, invalidservices[i].Port)
+			assert.Error(t, err, "%q", test.name)
 		}
 	}
 }
+
+func Test_MarshalServicesRoundTrip(t *testing.T) {
+	services := []*Service{
+		{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "host1", SchemaVersion: 1},
+		{Name: "serviceB", Port: 53, Protocol: ProtocolUDP, SchemaVersion: 1},
+		{Name: "serviceC", Port: 3, Protocol: ProtocolTCP, Tags: map[string]string{"env": "prod"}, SchemaVersion: 1},
+	}
+
+	bytes, err := MarshalServices(services)
+	assert.NoError(t, err)
+	got, err := UnmarshalServices(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, services, got)
+
+	bytes, err = MarshalServices(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", string(bytes))
+
+	got, err = UnmarshalServices([]byte(`[{"name":"serviceA","port":1}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*Service{{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, SchemaVersion: 1}}, got)
+
+	_, err = UnmarshalServices([]byte(`{"name":"serviceA"}`))
+	assert.Error(t, err)
+}
+
+func Test_ServiceUnmarshalJSON(t *testing.T) {
+	var svc Service
+	assert.NoError(t, json.Unmarshal([]byte(`{"name":"serviceA","port":1}`), &svc))
+	assert.Equal(t, Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, SchemaVersion: 1}, svc)
+
+	// a partial entry decodes so it can be completed from its key
+	svc = Service{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"hostname":"host1"}`), &svc))
+	assert.Equal(t, Service{Protocol: ProtocolTCP, Hostname: "host1", SchemaVersion: 1}, svc)
+
+	for _, bad := range []string{
+		`{"name":"serviceA","port":0}`,
+		`{"name":"serviceA","port":-1}`,
+		`{"name":"serviceA","port":65536}`,
+		`{"name":"serviceA","port":"80"}`,
+		`{"name":"serviceA"`,
+	} {
+		_, err := UnmarshalService([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+
+	// the check applies wherever a Service is decoded
+	_, err := UnmarshalServices([]byte(`[{"name":"serviceA","port":1},{"name":"serviceB","port":70000}]`))
+	assert.Error(t, err)
+}
+
+func Test_ServiceValidationErrors(t *testing.T) {
+	tests := []struct {
+		svc *Service
+		err error
+	}{
+		{&Service{Port: 1}, ErrMissingName},
+		{&Service{Name: "a/b", Port: 1}, ErrInvalidName},
+		{&Service{Name: "a\nb", Port: 1}, ErrInvalidName},
+		{&Service{Name: "serviceA"}, ErrInvalidPort},
+		{&Service{Name: "serviceA", Port: 65536}, ErrInvalidPort},
+		{&Service{Name: "serviceA", Port: 1, Hostname: "host:1"}, ErrInvalidHostname},
+		{&Service{Name: "serviceA", Port: 1, Protocol: "sctp"}, ErrInvalidProtocol},
+		{&Service{Name: "serviceA", Port: 1, Tags: map[string]string{"port": "2"}}, ErrReservedTag},
+		{&Service{Name: "a:b", Port: 1}, ErrInvalidName},
+		{&Service{Name: "serviceA", Port: 1, Hostname: "a/b"}, ErrInvalidHostname},
+		{&Service{Name: "serviceA", Port: 1, Address: "host1"}, ErrInvalidAddress},
+		{&Service{Name: "serviceA", Port: 1, Priority: -1}, ErrInvalidWeight},
+	}
+
+	for _, test := range tests {
+		err := test.svc.Validate()
+		assert.True(t, errors.Is(err, test.err), "%v: got %v, want %v", test.svc, err, test.err)
+		var verr *ValidationError
+		assert.True(t, errors.As(err, &verr), "%v", test.svc)
+	}
+
+	// a valid service passes, unchanged
+	svc := &Service{Name: "serviceA", Port: 65535, Protocol: ProtocolUDP, Hostname: "host1",
+		Address: "::1", Weight: 1, Tags: map[string]string{"env": "prod"}}
+	clone := svc.Clone()
+	assert.NoError(t, svc.Validate())
+	assert.Equal(t, clone, svc)
+
+	_, err := UnmarshalService([]byte(`{"name":"serviceA","port":0}`))
+	assert.True(t, errors.Is(err, ErrInvalidPort))
+
+	// with no local hostname to fall back on
+	defer noHostname(t)()
+	err = NewRegistry(NewMemoryBackend(), WithStrictValidation()).RegisterAll([]*Service{{Name: "serviceA", Port: 1}})
+	assert.True(t, errors.Is(err, ErrMissingHostname))
+}
+
+func Test_ServiceAddress(t *testing.T) {
+	svc := &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "c0ffee", Address: "10.0.0.1", SchemaVersion: 1}
+	bytes, err := svc.Marshal()
+	assert.NoError(t, err)
+	got, err := UnmarshalService(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, svc, got)
+
+	// the key doesn't change with the address
+	assert.Equal(t, RegistryPath+"/serviceA/tcp:1", svc.path())
+
+	bytes, err = (&Service{Name: "serviceA", Port: 1}).Marshal()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(bytes), "address")
+
+	assert.NoError(t, (&Service{Name: "serviceA", Port: 1, Address: "fe80::1"}).Validate())
+	for _, bad := range []string{"host1", "10.0.0", "10.0.0.1:80"} {
+		err := (&Service{Name: "serviceA", Port: 1, Address: bad}).Validate()
+		assert.True(t, errors.Is(err, ErrInvalidAddress), bad)
+	}
+}
+
+func Test_ValidationErrorCarriesService(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	r := NewInMemoryRegistry()
+
+	err := r.Register("serviceA", 70000)
+	var verr *ValidationError
+	if assert.True(t, errors.As(err, &verr)) {
+		assert.Equal(t, "serviceA", verr.Service.Name)
+		assert.Equal(t, 70000, verr.Service.Port)
+		assert.Equal(t, "host1", verr.Service.Hostname)
+		assert.True(t, errors.Is(err, ErrInvalidPort))
+		assert.Contains(t, err.Error(), ErrInvalidPort.Error())
+	}
+
+	err = r.RegisterWithTags("serviceA", 1, map[string]string{"name": "x"})
+	if assert.True(t, errors.As(err, &verr)) {
+		assert.Equal(t, map[string]string{"name": "x"}, verr.Service.Tags)
+		assert.True(t, errors.Is(err, ErrReservedTag))
+	}
+
+	// the error keeps the service as it was, whatever happens to the original
+	svc := &Service{Name: "", Port: 1}
+	err = svc.Validate()
+	svc.Name = "changed"
+	if assert.True(t, errors.As(err, &verr)) {
+		assert.Equal(t, "", verr.Service.Name)
+	}
+
+	_, err = UnmarshalService([]byte(`{"name":"serviceB","port":0}`))
+	if assert.True(t, errors.As(err, &verr)) {
+		assert.Equal(t, "serviceB", verr.Service.Name)
+		assert.Equal(t, 0, verr.Service.Port)
+	}
+}
+
+func Test_ServiceString(t *testing.T) {
+	assert.Equal(t, "serviceA:1", (&Service{Name: "serviceA", Port: 1}).String())
+	assert.Equal(t, "serviceA:1@host1", (&Service{Name: "serviceA", Port: 1, Hostname: "host1"}).String())
+	assert.Equal(t, "dns:53/udp@host1", (&Service{Name: "dns", Port: 53, Protocol: ProtocolUDP, Hostname: "host1"}).String())
+	assert.Equal(t, "<nil>", (*Service)(nil).String())
+
+	err := (&Service{Name: "serviceA", Port: 0, Hostname: "host1"}).Validate()
+	assert.Equal(t, "Service Port is outside valid range: serviceA:0@host1", err.Error())
+}
+
+func Test_ServiceSchemaVersion(t *testing.T) {
+	backend := NewMemoryBackend()
+	r := NewRegistry(backend)
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.Contains(t, backend.entries[RegistryPath+"/serviceA/tcp:1"].value, `"schema":1`)
+
+	// entries from before versioning are version 1
+	svc, err := UnmarshalService([]byte(`{"name":"serviceA","port":1}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, svc.SchemaVersion)
+
+	// a newer entry keeps its version and the fields this version knows
+	capture := &captureLogger{}
+	defer useLogger(capture)()
+	svc, err = UnmarshalService([]byte(`{"name":"serviceA","port":1,"hostname":"host1","schema":2,"zone":"b"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "host1", SchemaVersion: 2}, svc)
+	if assert.Equal(t, 1, len(capture.entries)) {
+		assert.Equal(t, "warn", capture.entries[0].level)
+		assert.Equal(t, 2, capture.entries[0].fields["schema"])
+	}
+}
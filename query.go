@@ -0,0 +1,181 @@
+package portmapper
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// GetService returns every registered instance of the named service, one per
+// (host, port) it was registered under.
+func (r *Registry) GetService(name string) ([]*Service, error) {
+	return r.filter(func(svc *Service) bool { return svc.Name == name })
+}
+
+// ServicesByHostname returns the services registered from hostname, e.g. to
+// check that a node has drained during a rolling deploy.
+func (r *Registry) ServicesByHostname(hostname string) ([]*Service, error) {
+	return r.filter(func(svc *Service) bool { return svc.Hostname == hostname })
+}
+
+// ServicesByTag returns the services tagged with key set to value, e.g. to
+// discover only the instances of one environment or version. Services
+// without the tag are left out even when value is empty.
+func (r *Registry) ServicesByTag(key, value string) ([]*Service, error) {
+	return r.filter(func(svc *Service) bool {
+		v, ok := svc.Tags[key]
+		return ok && v == value
+	})
+}
+
+// GetServiceByPort returns the service registered from this host on port,
+// for tracking down who claims a port. This host is the Hostname Register
+// would use. If both a tcp and a udp service hold the port the tcp one is
+// returned, whatever their names. With no match the error wraps
+// ErrNotRegistered.
+func (r *Registry) GetServiceByPort(port int) (*Service, error) {
+	hostname := localHostname()
+	services, err := r.filter(func(svc *Service) bool {
+		return svc.Port == port && svc.Hostname == hostname
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("%w: port %d on %q", ErrNotRegistered, port, hostname)
+	}
+
+	// services are sorted by name first, so look for tcp explicitly
+	for _, svc := range services {
+		if svc.protocol() == ProtocolTCP {
+			return svc, nil
+		}
+	}
+	return services[0], nil
+}
+
+// ServicesMap returns the registered services grouped by Name. Each group is
+// in the order Services returns them, and an empty registry gives an empty
+// map.
+func (r *Registry) ServicesMap() (map[string][]*Service, error) {
+	services, err := r.Services()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string][]*Service)
+	for _, svc := range services {
+		byName[svc.Name] = append(byName[svc.Name], svc)
+	}
+
+	return byName, nil
+}
+
+// Stats summarises the registry for dashboards.
+type Stats struct {
+	TotalInstances int
+	DistinctNames  int
+	// InstancesPerHost counts instances by Hostname. Those registered without
+	// one are counted under "".
+	InstancesPerHost map[string]int
+}
+
+// RegistryStats counts the registered services from a single enumeration.
+func (r *Registry) RegistryStats() (Stats, error) {
+	services, err := r.Services()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{TotalInstances: len(services), InstancesPerHost: map[string]int{}}
+	names := map[string]bool{}
+	for _, svc := range services {
+		names[svc.Name] = true
+		stats.InstancesPerHost[svc.Hostname]++
+	}
+	stats.DistinctNames = len(names)
+
+	return stats, nil
+}
+
+// ServiceNames returns the distinct names of the registered services, sorted,
+// for catalogs that list names rather than instances. The names come from the
+// keys of a single enumeration, so no entry is decoded; unlike Services, a
+// name is listed even if every entry under it is malformed.
+func (r *Registry) ServiceNames() ([]string, error) {
+	if err := r.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	nodes, _, err := r.serviceNodes(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	names := []string{}
+	for _, node := range nodes {
+		svc, ok := parseKey(r.root(), node.Key)
+		if !ok || seen[svc.Name] || validateName(svc.Name) != nil {
+			continue
+		}
+		seen[svc.Name] = true
+		names = append(names, svc.Name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// filter returns the registered services for which keep returns true. The
+// result is empty rather than nil when nothing matches.
+func (r *Registry) filter(keep func(*Service) bool) ([]*Service, error) {
+	services, err := r.Services()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []*Service{}
+	for _, svc := range services {
+		if keep(svc) {
+			matches = append(matches, svc)
+		}
+	}
+
+	return matches, nil
+}
+
+// Count returns how many service entries are registered without decoding any
+// of them. Entries live one directory below the root, so this counts leaf
+// keys rather than the root's immediate children.
+func (r *Registry) Count() (int, error) {
+	if err := r.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	var (
+		resp  *client.Response
+		empty bool
+	)
+
+	err := r.retry(context.Background(), "count", Fields{"action": "Count Services"}, func(ctx context.Context) error {
+		var err error
+		resp, err = r.backend.Get(ctx, r.root(), &client.GetOptions{Recursive: true})
+		if isKeyNotFound(err) {
+			empty = true
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if empty || resp == nil {
+		return 0, nil
+	}
+
+	return len(leaves(resp.Node, nil)), nil
+}
@@ -0,0 +1,219 @@
+package portmapper
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_GetService(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceA", Port: 1, Hostname: "host1"},
+		&Service{Name: "serviceB", Port: 2, Hostname: "host1"},
+		&Service{Name: "serviceA", Port: 3, Hostname: "host2"},
+		&Service{Name: "serviceAB", Port: 4, Hostname: "host2"},
+	)})
+
+	services, err := r.GetService("serviceA")
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(services)) {
+		assert.Equal(t, 1, services[0].Port)
+		assert.Equal(t, 3, services[1].Port)
+	}
+
+	services, err = r.GetService("serviceC")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(services))
+}
+
+func Test_GetServiceByPort(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	r := NewRegistry(&fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceA", Port: 1, Hostname: "host1"},
+		&Service{Name: "serviceB", Port: 2, Hostname: "host1"},
+		&Service{Name: "serviceC", Port: 3, Hostname: "host2"},
+		&Service{Name: "serviceD", Port: 2, Hostname: "host2"},
+	)})
+
+	svc, err := r.GetServiceByPort(2)
+	assert.NoError(t, err)
+	if assert.NotNil(t, svc) {
+		assert.Equal(t, "serviceB", svc.Name)
+	}
+
+	// port 3 is only taken on another host
+	svc, err = r.GetServiceByPort(3)
+	assert.True(t, errors.Is(err, ErrNotRegistered))
+	assert.Nil(t, svc)
+
+	// tcp wins over udp even when the udp service sorts first
+	r = NewRegistry(&fakeKeysAPI{get: registryGet(
+		&Service{Name: "a", Port: 53, Protocol: ProtocolUDP, Hostname: "host1"},
+		&Service{Name: "b", Port: 53, Protocol: ProtocolTCP, Hostname: "host1"},
+	)})
+	svc, err = r.GetServiceByPort(53)
+	assert.NoError(t, err)
+	if assert.NotNil(t, svc) {
+		assert.Equal(t, "b", svc.Name)
+	}
+}
+
+func Test_ServicesMap(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceA", Port: 3, Hostname: "host2"},
+		&Service{Name: "serviceB", Port: 2, Hostname: "host1"},
+		&Service{Name: "serviceA", Port: 1, Hostname: "host1"},
+	)})
+
+	byName, err := r.ServicesMap()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(byName))
+	if assert.Equal(t, 2, len(byName["serviceA"])) {
+		assert.Equal(t, 1, byName["serviceA"][0].Port)
+		assert.Equal(t, 3, byName["serviceA"][1].Port)
+	}
+	if assert.Equal(t, 1, len(byName["serviceB"])) {
+		assert.Equal(t, "host1", byName["serviceB"][0].Hostname)
+	}
+
+	byName, err = NewInMemoryRegistry().ServicesMap()
+	assert.NoError(t, err)
+	assert.NotNil(t, byName)
+	assert.Equal(t, 0, len(byName))
+}
+
+func Test_RegistryStats(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceA", Port: 1, Hostname: "host1"},
+		&Service{Name: "serviceA", Port: 2, Hostname: "host2"},
+		&Service{Name: "serviceB", Port: 3, Hostname: "host1"},
+		&Service{Name: "serviceC", Port: 4, Hostname: "host1"},
+		&Service{Name: "serviceC", Port: 5},
+	)})
+
+	stats, err := r.RegistryStats()
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{
+		TotalInstances:   5,
+		DistinctNames:    3,
+		InstancesPerHost: map[string]int{"host1": 3, "host2": 1, "": 1},
+	}, stats)
+
+	stats, err = NewInMemoryRegistry().RegistryStats()
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{InstancesPerHost: map[string]int{}}, stats)
+}
+
+func Test_ServiceNames(t *testing.T) {
+	kapi := &fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceC", Port: 1, Hostname: "host1"},
+		&Service{Name: "serviceA", Port: 2, Hostname: "host2"},
+		&Service{Name: "serviceB", Port: 3, Hostname: "host1"},
+		&Service{Name: "serviceA", Port: 4, Hostname: "host1"},
+		&Service{Name: "serviceC", Port: 5, Protocol: ProtocolUDP},
+		&Service{Name: "serviceA", Port: 6},
+	)}
+	r := NewRegistry(kapi)
+
+	names, err := r.ServiceNames()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"serviceA", "serviceB", "serviceC"}, names)
+	assert.Equal(t, 1, kapi.gets)
+
+	names, err = NewInMemoryRegistry().ServiceNames()
+	assert.NoError(t, err)
+	assert.NotNil(t, names)
+	assert.Empty(t, names)
+}
+
+func Test_ServicesByHostname(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceA", Port: 1, Hostname: "host1"},
+		&Service{Name: "serviceB", Port: 2, Hostname: "host2"},
+		&Service{Name: "serviceC", Port: 3, Hostname: "host1"},
+	)})
+
+	services, err := r.ServicesByHostname("host1")
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(services)) {
+		assert.Equal(t, "serviceA", services[0].Name)
+		assert.Equal(t, "serviceC", services[1].Name)
+	}
+}
+
+func Test_ServicesByHostnameEmptyRegistry(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key}
+	}})
+
+	services, err := r.ServicesByHostname("host1")
+	assert.NoError(t, err)
+	assert.NotNil(t, services)
+	assert.Equal(t, 0, len(services))
+}
+
+func Test_ServicesByTag(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceA", Port: 1, Tags: map[string]string{"env": "prod", "version": "2"}},
+		&Service{Name: "serviceB", Port: 2, Tags: map[string]string{"env": "staging"}},
+		&Service{Name: "serviceC", Port: 3},
+		&Service{Name: "serviceD", Port: 4, Tags: map[string]string{"env": "prod", "canary": ""}},
+	)})
+
+	byName := func(services []*Service, err error) []string {
+		assert.NoError(t, err)
+		assert.NotNil(t, services)
+		var got []string
+		for _, svc := range services {
+			got = append(got, svc.Name)
+		}
+		return got
+	}
+	assert.Equal(t, []string{"serviceA", "serviceD"}, byName(r.ServicesByTag("env", "prod")))
+	assert.Equal(t, []string{"serviceB"}, byName(r.ServicesByTag("env", "staging")))
+	assert.Empty(t, byName(r.ServicesByTag("env", "dev")))
+
+	// a missing key never matches, even an empty value
+	assert.Empty(t, byName(r.ServicesByTag("region", "")))
+	assert.Equal(t, []string{"serviceD"}, byName(r.ServicesByTag("canary", "")))
+}
+
+func Test_Count(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceA", Port: 1, Hostname: "host1"},
+		&Service{Name: "serviceA", Port: 2, Hostname: "host1"},
+		&Service{Name: "serviceB", Port: 3, Hostname: "host2"},
+	)})
+
+	n, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+}
+
+func Test_CountDoesNotDecode(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		return &client.Response{Node: &client.Node{Key: key, Dir: true, Nodes: client.Nodes{
+			{Key: key + "/serviceA", Dir: true, Nodes: client.Nodes{
+				{Key: key + "/serviceA/tcp:1", Value: "not json"},
+			}},
+			{Key: key + "/serviceB:2", Value: "{}"},
+		}}}, nil
+	}})
+
+	n, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func Test_CountEmptyRegistry(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		return nil, client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key}
+	}})
+
+	n, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,1115 @@
+package portmapper
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Registry registers and enumerates services through a single Backend, so
+// one client can be shared across calls.
+type Registry struct {
+	backend   Backend
+	prefix    string
+	policy    *RetryPolicy
+	failFast  bool
+	budget    *retryBudget
+	breaker   *circuitBreaker
+	strict    bool
+	rejectLow bool
+	conflicts bool
+	readOnly  bool
+	dryRun    bool
+	codec     Codec
+
+	// endpoints is only for logging which cluster failed
+	endpoints []string
+	hooks     Hooks
+
+	// ctx is cancelled by Close to stop background goroutines, which wg
+	// tracks. closing is set once Close starts and guarded by mu.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	closing bool
+
+	// heartbeats holds the keepalives by TTL, guarded by kaMu. kaMu may be
+	// held while taking mu but not the other way round.
+	kaMu       sync.Mutex
+	heartbeats map[time.Duration]*heartbeat
+
+	cache servicesCache
+
+	// owned holds what Reregister rewrites, by key, guarded by ownMu. No
+	// other lock is taken while holding ownMu.
+	ownMu sync.Mutex
+	owned map[string]registration
+
+	// warnNoHostname makes the missing hostname warning a one-off, since it
+	// is usually the environment rather than one service that is at fault
+	warnNoHostname sync.Once
+}
+
+// ErrClosed is returned by Registry methods called after Close.
+var ErrClosed = errors.New("registry is closed")
+
+// Option configures a Registry when it is created.
+type Option func(*Registry)
+
+// WithRetryPolicy makes the Registry retry timed out etcd requests according
+// to p rather than DefaultRetryPolicy.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(r *Registry) {
+		r.policy = &p
+	}
+}
+
+// WithStrictValidation makes the Registry refuse to register services that
+// have no Hostname, since consumers have no way to reach them. It also turns
+// on WithConflictCheck.
+func WithStrictValidation() Option {
+	return func(r *Registry) {
+		r.strict = true
+		r.conflicts = true
+	}
+}
+
+// WithRejectPrivilegedPorts makes the Registry refuse, with an error wrapping
+// ErrPrivilegedPort, to register services on ports below 1024, for
+// deployments where nothing should be listening there. It is separate from
+// WithStrictValidation because plenty of strict registries serve on 80 or
+// 443; leaving it out is what permits privileged ports.
+func WithRejectPrivilegedPorts() Option {
+	return func(r *Registry) {
+		r.rejectLow = true
+	}
+}
+
+// WithConflictCheck makes the Registry read a service's key before writing
+// it and refuse, with an error wrapping ErrHostnameConflict, if another
+// Hostname already holds it. Two hosts claiming the same name and port is
+// almost always a misconfiguration.
+func WithConflictCheck() Option {
+	return func(r *Registry) {
+		r.conflicts = true
+	}
+}
+
+// WithReadOnly makes the Registry refuse every write with ErrReadOnly, before
+// anything is sent to etcd, for consumers such as dashboards that should
+// only ever read. Services, Watch and the other reads work as usual.
+func WithReadOnly() Option {
+	return func(r *Registry) {
+		r.readOnly = true
+	}
+}
+
+// WithDryRun makes the Registry validate, encode and log each write it would
+// make without sending it to etcd, so a deployment can be checked before it
+// touches the cluster. Reads still go to etcd, and no hooks fire for the
+// skipped writes.
+func WithDryRun() Option {
+	return func(r *Registry) {
+		r.dryRun = true
+	}
+}
+
+// ErrReadOnly is returned by the registering and unregistering methods of a
+// registry created with WithReadOnly.
+var ErrReadOnly = errors.New("registry is read-only")
+
+// ErrHostnameConflict is wrapped by the error returned when a registry with
+// WithConflictCheck finds a service's key held by a different Hostname.
+var ErrHostnameConflict = errors.New("service registered from another host")
+
+// WithEndpoints records the etcd endpoints behind the Registry's backend so
+// that retry and failure logs can name them. It doesn't change where requests
+// go.
+func WithEndpoints(endpoints ...string) Option {
+	return func(r *Registry) {
+		r.endpoints = append([]string(nil), endpoints...)
+	}
+}
+
+// NewRegistry returns a Registry backed by backend, usually an etcd
+// client.KeysAPI, that stores services under RegistryPath.
+func NewRegistry(backend Backend, opts ...Option) *Registry {
+	return NewRegistryWithPrefix(backend, "", opts...)
+}
+
+// NewRegistryWithPrefix returns a Registry backed by backend that stores
+// services under prefix instead of RegistryPath, so several registries can
+// share a cluster without seeing each other's entries.
+func NewRegistryWithPrefix(backend Backend, prefix string, opts ...Option) *Registry {
+	r := &Registry{backend: backend, prefix: prefix, codec: JSONCodec{}}
+	r.cache.ttl, r.cache.now = DefaultCacheTTL, time.Now
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// Close stops the registry's keepalives and watches and waits for them to
+// finish. Keepalive and auto-unregistered services are unregistered on the
+// way out. Other methods return ErrClosed afterwards. Closing twice is a
+// no-op. The etcd client itself holds no resources that need releasing.
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	if r.closing {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closing = true
+	r.mu.Unlock()
+
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+// checkOpen returns ErrClosed once Close has been called.
+func (r *Registry) checkOpen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closing {
+		return ErrClosed
+	}
+	return nil
+}
+
+// checkWritable returns ErrClosed once Close has been called and ErrReadOnly
+// for a read-only registry.
+func (r *Registry) checkWritable() error {
+	if err := r.checkOpen(); err != nil {
+		return err
+	}
+	if r.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// spawn runs fn in a goroutine that Close waits for. It returns false
+// without running fn if the registry is closing.
+func (r *Registry) spawn(fn func()) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closing {
+		return false
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// bind returns a copy of ctx that is also cancelled when the registry is
+// closed.
+func (r *Registry) bind(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-r.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// root returns the etcd directory this registry's services live under.
+func (r *Registry) root() string {
+	if r.prefix == "" {
+		return RegistryPath
+	}
+	return r.prefix
+}
+
+// path returns the etcd key svc is stored at in this registry.
+func (r *Registry) path(svc *Service) string {
+	return svc.pathIn(r.root())
+}
+
+// osHostname is os.Hostname, replaceable in tests.
+var osHostname = os.Hostname
+
+// localHostname returns the Hostname services are registered with when the
+// caller doesn't give one: HOSTNAME if set, otherwise the kernel's hostname,
+// otherwise empty.
+func localHostname() string {
+	if h := strings.TrimSpace(os.Getenv("HOSTNAME")); h != "" {
+		return h
+	}
+	if h, err := osHostname(); err == nil {
+		return h
+	}
+	return ""
+}
+
+// localRegion returns the Region services are registered with when the caller
+// doesn't give one: POMAPPER_REGION if set, otherwise AWS_REGION, otherwise
+// empty.
+func localRegion() string {
+	for _, env := range []string{"POMAPPER_REGION", "AWS_REGION"} {
+		if region := strings.TrimSpace(os.Getenv(env)); region != "" {
+			return region
+		}
+	}
+	return ""
+}
+
+// Unregister a (service, port) tuple. A tuple that isn't registered is not an
+// error, so cleanup can safely run more than once.
+func (r *Registry) Unregister(name string, port int) error {
+	return r.UnregisterContext(context.Background(), name, port)
+}
+
+// UnregisterContext unregisters a (service, port) tuple, giving up as soon as
+// ctx is done.
+func (r *Registry) UnregisterContext(ctx context.Context, name string, port int) error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+
+	return r.unregister(ctx, &Service{Name: name, Port: port, Hostname: localHostname()})
+}
+
+// UnregisterInstance deletes exactly the key svc is stored at, protocol
+// included, where Unregister assumes tcp. It is named apart from
+// UnregisterService, which removes every instance of a name.
+func (r *Registry) UnregisterInstance(svc *Service) error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+
+	return r.unregister(context.Background(), svc)
+}
+
+// unregister validates svc and deletes its key, retrying timeouts. A key
+// that is already gone counts as success, so cleanup is safe to repeat, but
+// isn't reported to OnUnregister.
+func (r *Registry) unregister(ctx context.Context, svc *Service) (err error) {
+	missing, dry := false, false
+	defer func() {
+		if err != nil {
+			r.hooks.failed("unregister", err)
+		} else if !missing && !dry {
+			r.hooks.unregistered(svc)
+		}
+	}()
+
+	// service doesn't have a name or has an invalid port
+	if err := svc.Validate(); err != nil {
+		logger().Error("Service Validation Failed.", Fields{
+			"action":  "Validate",
+			"service": svc.Name,
+			"port":    svc.Port,
+			"errstr":  err.Error(),
+		})
+		return err
+	}
+
+	fields := Fields{
+		"action":  "Validate",
+		"service": svc.Name,
+		"port":    svc.Port,
+	}
+
+	if r.dryRun {
+		dry = true
+		logger().Info("Dry run: not unregistering service from etcd", fields.with(Fields{"path": r.path(svc)}))
+		return nil
+	}
+
+	// attempt to delete the svc's path with exponential backoff
+	err = r.retry(ctx, "path deletion", fields, func(ctx context.Context) error {
+		_, err := r.backend.Delete(ctx, r.path(svc), nil)
+		if isKeyNotFound(err) {
+			// never registered, or an earlier attempt that timed out did
+			// delete it
+			missing = true
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	r.disown(r.path(svc))
+	if missing {
+		logger().Debug("Service was not registered with etcd", fields.with(Fields{"path": r.path(svc)}))
+		return nil
+	}
+
+	logger().Info("Successfully unregistered service with etcd", Fields{
+		"action":  "set",
+		"service": svc.Name,
+		"port":    svc.Port,
+		"path":    r.path(svc),
+	})
+	return nil
+}
+
+// Register a service with etcd
+func (r *Registry) Register(name string, port int) error {
+	return r.RegisterContext(context.Background(), name, port)
+}
+
+// RegisterContext registers a service with etcd, giving up as soon as ctx is
+// done.
+func (r *Registry) RegisterContext(ctx context.Context, name string, port int) error {
+	return r.register(ctx, &Service{Name: name, Port: port, Hostname: localHostname()}, nil)
+}
+
+// RegisterWithHostname registers a service under an explicit hostname, such as
+// a routable address, for runtimes where HOSTNAME isn't what consumers should
+// dial. An empty hostname falls back to localHostname as with Register.
+func (r *Registry) RegisterWithHostname(name string, port int, hostname string) error {
+	if strings.TrimSpace(hostname) == "" {
+		hostname = localHostname()
+	}
+	return r.register(context.Background(), &Service{Name: name, Port: port, Hostname: hostname}, nil)
+}
+
+// RegisterWithAddress registers a service with the IP address consumers
+// should connect to. Hostname is still filled in as with Register, as a
+// readable identity.
+func (r *Registry) RegisterWithAddress(name string, port int, address string) error {
+	svc := &Service{Name: name, Port: port, Hostname: localHostname(), Address: address}
+	return r.register(context.Background(), svc, nil)
+}
+
+// RegisterURL registers a service at rawurl, such as "grpc://10.0.0.1:9090",
+// for consumers that dial URLs. The URL is stored as given, along with the
+// Port it names, which it must name explicitly; one that doesn't parse is
+// rejected with an error wrapping ErrInvalidURL. If the URL's host is an IP
+// it is the Address too. Hostname is filled in as with Register.
+func (r *Registry) RegisterURL(name, rawurl string) error {
+	svc := &Service{Name: name, Hostname: localHostname(), URL: rawurl}
+	u, port, err := parseURL(rawurl)
+	if err != nil {
+		logger().Error("Service Validation Failed.", Fields{
+			"action":  "Validate",
+			"service": name,
+			"url":     rawurl,
+			"errstr":  err.Error(),
+		})
+		return invalid(svc, fmt.Errorf("%w: %v", ErrInvalidURL, err))
+	}
+
+	svc.Port = port
+	if net.ParseIP(u.Hostname()) != nil {
+		svc.Address = u.Hostname()
+	}
+	return r.register(context.Background(), svc, nil)
+}
+
+// RegisterWithTags registers a service labelled with tags, which discovery
+// consumers can filter on.
+func (r *Registry) RegisterWithTags(name string, port int, tags map[string]string) error {
+	svc := &Service{Name: name, Port: port, Hostname: localHostname(), Tags: tags}
+	return r.register(context.Background(), svc, nil)
+}
+
+// RegisterWeighted registers a service with the weight and priority load
+// balancers should give it. See Service.Weight.
+func (r *Registry) RegisterWeighted(name string, port, weight, priority int) error {
+	svc := &Service{Name: name, Port: port, Hostname: localHostname(), Weight: weight, Priority: priority}
+	return r.register(context.Background(), svc, nil)
+}
+
+// RegisterWithRegion registers a service in region, overriding the one taken
+// from the environment. See Service.Region.
+func (r *Registry) RegisterWithRegion(name string, port int, region string) error {
+	svc := &Service{Name: name, Port: port, Hostname: localHostname(), Region: region}
+	return r.register(context.Background(), svc, nil)
+}
+
+// ErrInvalidTTL is wrapped by the error returned for a TTL under a second.
+// etcd counts TTLs in whole seconds, so a shorter one would be sent as none
+// at all and the key would never expire.
+var ErrInvalidTTL = errors.New("TTL must be at least a second")
+
+// checkTTL returns an error wrapping ErrInvalidTTL if ttl is under a second.
+func checkTTL(ttl time.Duration) error {
+	if ttl < time.Second {
+		return fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	}
+	return nil
+}
+
+// RegisterTTL registers a service whose key expires after ttl unless it is
+// registered again before then, so a crashed service drops out of the
+// registry on its own. ttl must be at least a second.
+func (r *Registry) RegisterTTL(name string, port int, ttl time.Duration) error {
+	if err := checkTTL(ttl); err != nil {
+		return err
+	}
+
+	svc := &Service{Name: name, Port: port, Hostname: localHostname()}
+	return r.register(context.Background(), svc, &client.SetOptions{TTL: ttl})
+}
+
+// ErrMissingHostname is wrapped by the error a registry created with
+// WithStrictValidation returns for a service without a Hostname.
+var ErrMissingHostname = errors.New("Service lacks Hostname field")
+
+// ErrPrivilegedPort is wrapped by the error a registry created with
+// WithRejectPrivilegedPorts returns for a service on a port below 1024. A
+// service on port 22 or 80 is usually a typo or a port mapping read from the
+// wrong side.
+var ErrPrivilegedPort = errors.New("Service Port is privileged")
+
+// ErrAlreadyRegistered is returned by RegisterExclusive when another instance
+// already holds the service's key.
+var ErrAlreadyRegistered = errors.New("service already registered")
+
+// RegisterExclusive registers a service only if nothing is registered under
+// the same name, protocol and port yet, so exactly one of several racing
+// instances wins. The others get an error wrapping ErrAlreadyRegistered.
+func (r *Registry) RegisterExclusive(name string, port int) error {
+	svc := &Service{Name: name, Port: port, Hostname: localHostname()}
+	err := r.register(context.Background(), svc, &client.SetOptions{PrevExist: client.PrevNoExist})
+	if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+		return fmt.Errorf("%w: %s", ErrAlreadyRegistered, r.path(svc))
+	}
+
+	return err
+}
+
+// ErrNotRegistered is wrapped by the errors returned when an operation needs
+// an existing registration and there is none.
+var ErrNotRegistered = errors.New("service not registered")
+
+// Refresh rewrites an existing registration with svc's current value, e.g.
+// after its tags or address change. The key is unchanged, and so is its TTL:
+// a registration this registry made is rewritten with the TTL it was made
+// with, and any other keeps the time it has left. It fails with an error
+// wrapping ErrNotRegistered if the entry has been deleted or has expired,
+// rather than recreating it.
+func (r *Registry) Refresh(svc *Service) error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+	if err := svc.Validate(); err != nil {
+		return err
+	}
+
+	node, err := r.lookupNode(context.Background(), svc, "Refresh")
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return fmt.Errorf("%w: %s", ErrNotRegistered, r.path(svc))
+	}
+
+	// a set without a TTL would make the entry permanent
+	opts := &client.SetOptions{PrevExist: client.PrevExist, TTL: remainingTTL(node)}
+	if reg, ok := r.ownedAt(r.path(svc)); ok {
+		opts.TTL = reg.ttl
+	}
+	err = r.register(context.Background(), svc, opts)
+	if isKeyNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrNotRegistered, r.path(svc))
+	}
+
+	return err
+}
+
+// lookupNode reads the entry at svc's key, retrying timeouts. It returns a
+// nil node if there is none.
+func (r *Registry) lookupNode(ctx context.Context, svc *Service, action string) (*client.Node, error) {
+	var node *client.Node
+	fields := Fields{
+		"action":  action,
+		"service": svc.Name,
+		"port":    svc.Port,
+	}
+	err := r.retry(ctx, "lookup", fields, func(ctx context.Context) error {
+		resp, err := r.backend.Get(ctx, r.path(svc), nil)
+		if isKeyNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		node = resp.Node
+		return nil
+	})
+	return node, err
+}
+
+// remainingTTL returns the TTL that keeps node expiring when it would have,
+// or zero if it doesn't expire. A TTL under a second would round down to
+// none at all, so it is at least a second.
+func remainingTTL(node *client.Node) time.Duration {
+	if node.Expiration == nil {
+		return 0
+	}
+	if ttl := time.Until(*node.Expiration); ttl > time.Second {
+		return ttl
+	}
+	return time.Second
+}
+
+// RegisterAll registers several services through the registry's one client.
+// Every service is validated first and nothing is written if any is
+// invalid. Otherwise each is registered in turn and the failures, if any,
+// are returned together. Services without a Hostname get localHostname, and
+// those without a Region the local one, as with Register, before they are
+// validated. services themselves are left unchanged.
+func (r *Registry) RegisterAll(services []*Service) error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+
+	prepared := make([]*Service, len(services))
+	for i, svc := range services {
+		prepared[i] = prepare(svc)
+		if prepared[i].Hostname == "" {
+			prepared[i].Hostname = localHostname()
+		}
+	}
+	if err := validateAll(prepared, r.checkRegistration); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, svc := range prepared {
+		if err := r.register(context.Background(), svc, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// RegisterPorts registers a service on each of ports, such as a plaintext
+// and a TLS port, so that either all are registered or none are. etcd v2 has
+// no transactions, so if any write fails the ports this call registered are
+// unregistered again before the error is returned. Ports that were already
+// registered before the call are left as they are. A failure to roll back is
+// returned along with it.
+func (r *Registry) RegisterPorts(name string, ports []int) error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+
+	hostname := localHostname()
+	services := make([]*Service, len(ports))
+	for i, port := range ports {
+		services[i] = &Service{Name: name, Port: port, Hostname: hostname}
+	}
+	if err := validateAll(services, r.checkRegistration); err != nil {
+		return err
+	}
+
+	// only the ports this call creates are rolled back
+	existed := make([]bool, len(ports))
+	for i, port := range ports {
+		found, err := r.IsRegistered(name, port)
+		if err != nil {
+			return err
+		}
+		existed[i] = found
+	}
+
+	for i, svc := range services {
+		err := r.register(context.Background(), svc, nil)
+		if err == nil {
+			continue
+		}
+
+		errs := []error{err}
+		for j, written := range services[:i] {
+			if existed[j] {
+				continue
+			}
+			if err := r.unregister(context.Background(), written); err != nil {
+				errs = append(errs, fmt.Errorf("rolling back port %d: %w", written.Port, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+// UnregisterAll unregisters several services, validating all of them before
+// deleting anything and returning every failure together.
+func (r *Registry) UnregisterAll(services []*Service) error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+	if err := validateAll(services, (*Service).Validate); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, svc := range services {
+		if err := r.unregister(context.Background(), svc); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// UnregisterService removes every registration of the named service, on any
+// port, protocol or host, and returns how many were removed. The service's
+// directory goes in a single recursive delete; entries under the older flat
+// key layout are deleted one by one. If nothing was registered the error
+// wraps ErrNotRegistered.
+func (r *Registry) UnregisterService(name string) (int, error) {
+	if err := r.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := validateName(name); err != nil {
+		return 0, err
+	}
+
+	var resp *client.Response
+	fields := Fields{
+		"action":  "UnregisterService",
+		"service": name,
+	}
+
+	err := r.retry(context.Background(), "lookup", fields, func(ctx context.Context) error {
+		var err error
+		resp, err = r.backend.Get(ctx, r.root(), &client.GetOptions{Recursive: true})
+		if isKeyNotFound(err) {
+			// nothing has been registered at all
+			resp = nil
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	dir := r.root() + "/" + name
+	var (
+		inDir int
+		flat  []string
+	)
+	if resp != nil && resp.Node != nil {
+		for _, node := range leaves(resp.Node, nil) {
+			if strings.HasPrefix(node.Key, dir+"/") {
+				inDir++
+			} else if svc, ok := parseKey(r.root(), node.Key); ok && svc.Name == name {
+				flat = append(flat, node.Key)
+			}
+		}
+	}
+
+	if inDir+len(flat) == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNotRegistered, name)
+	}
+
+	keys := flat
+	if inDir > 0 {
+		keys = append(keys, dir)
+	}
+	count := inDir + len(flat)
+	if r.dryRun {
+		logger().Info("Dry run: not unregistering service from etcd", fields.with(Fields{
+			"count": count,
+			"keys":  keys,
+		}))
+		return count, nil
+	}
+	for _, key := range keys {
+		err := r.retry(context.Background(), "deletion", fields, func(ctx context.Context) error {
+			_, err := r.backend.Delete(ctx, key, &client.DeleteOptions{Recursive: key == dir})
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		r.disown(key)
+	}
+
+	logger().Info("Successfully unregistered service with etcd", fields.with(Fields{"count": count}))
+	return count, nil
+}
+
+// validateAll returns the first failure of check among services.
+func validateAll(services []*Service, check func(*Service) error) error {
+	for _, svc := range services {
+		if err := check(svc); err != nil {
+			logger().Error("Service Validation Failed.", Fields{
+				"action":  "Validate",
+				"service": svc.Name,
+				"port":    svc.Port,
+				"errstr":  err.Error(),
+			})
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkRegistration validates svc for writing, applying the registry's strict
+// rules on top of Service validation.
+func (r *Registry) checkRegistration(svc *Service) error {
+	if err := svc.Validate(); err != nil {
+		return err
+	}
+	if r.strict && svc.Hostname == "" {
+		return invalid(svc, ErrMissingHostname)
+	}
+	if r.rejectLow && svc.Port < 1024 {
+		return invalid(svc, fmt.Errorf("%w: %d is below 1024", ErrPrivilegedPort, svc.Port))
+	}
+
+	return nil
+}
+
+// prepare returns a copy of svc with surrounding whitespace trimmed from its
+// Hostname, which is common when HOSTNAME comes from a file, and its Region
+// filled in from the environment if unset, ready to be validated and written.
+func prepare(svc *Service) *Service {
+	svc = svc.Clone()
+	svc.Hostname = strings.TrimSpace(svc.Hostname)
+	if svc.Region == "" {
+		svc.Region = localRegion()
+	}
+	return svc
+}
+
+// register prepares a copy of svc, validates it and writes it to etcd
+// with opts, retrying timeouts.
+func (r *Registry) register(ctx context.Context, svc *Service, opts *client.SetOptions) error {
+	return r.write(ctx, svc, opts, false)
+}
+
+// write is register, except that a refresh of a registration already made,
+// such as a keepalive's, isn't reported to OnRegister and is logged at
+// Debug, since it happens every few seconds for as long as the service
+// lives.
+func (r *Registry) write(ctx context.Context, svc *Service, opts *client.SetOptions, refresh bool) (err error) {
+	dry := false
+	defer func() {
+		if err != nil {
+			r.hooks.failed("register", err)
+		} else if !dry && !refresh {
+			r.hooks.registered(svc)
+		}
+	}()
+	logSuccess := logger().Info
+	if refresh {
+		logSuccess = logger().Debug
+	}
+
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+	svc = prepare(svc)
+	if err := r.checkRegistration(svc); err != nil {
+		logger().Error("Service Validation Failed.", Fields{
+			"action":  "Validate",
+			"service": svc.Name,
+			"port":    svc.Port,
+			"errstr":  err.Error(),
+		})
+		return err
+	}
+	if svc.Hostname == "" {
+		r.warnNoHostname.Do(func() {
+			logger().Warn("Registering service without a hostname, so consumers can't route to it. Set HOSTNAME, or use WithStrictValidation to refuse such services", Fields{
+				"action":  "Validate",
+				"service": svc.Name,
+				"port":    svc.Port,
+			})
+		})
+	}
+
+	stored := *svc
+	stored.SchemaVersion = CurrentSchemaVersion
+	bytes, err := r.codec.Marshal(&stored)
+	if err != nil {
+		logger().Error("Marshalling Failed.", Fields{
+			"action":  "Marshall",
+			"service": svc.Name,
+			"port":    svc.Port,
+			"errstr":  err.Error(),
+		})
+		return err
+	}
+
+	fields := Fields{
+		"action":  "Register",
+		"service": svc.Name,
+		"port":    svc.Port,
+	}
+
+	if r.conflicts {
+		if err := r.checkConflict(ctx, svc); err != nil {
+			return err
+		}
+	}
+
+	if r.dryRun {
+		dry = true
+		logSuccess("Dry run: not registering service with etcd", fields.with(Fields{
+			"path":  r.path(svc),
+			"value": string(bytes),
+		}))
+		return nil
+	}
+
+	// attempt to set the svc's path with exponential backoff
+	err = r.retry(ctx, "registration", fields, func(ctx context.Context) error {
+		_, err := r.backend.Set(ctx, r.path(svc), string(bytes), opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.own(svc, opts)
+
+	logSuccess("Successfully registered service with etcd", Fields{
+		"action":  "set",
+		"service": svc.Name,
+		"port":    svc.Port,
+		"path":    r.path(svc),
+	})
+	return nil
+}
+
+// checkConflict returns an error if svc's key is held by a service with a
+// different Hostname. An entry with no Hostname, or one that won't decode,
+// is not treated as a conflict.
+func (r *Registry) checkConflict(ctx context.Context, svc *Service) error {
+	var resp *client.Response
+	fields := Fields{
+		"action":  "Register",
+		"service": svc.Name,
+		"port":    svc.Port,
+	}
+
+	err := r.retry(ctx, "lookup", fields, func(ctx context.Context) error {
+		var err error
+		resp, err = r.backend.Get(ctx, r.path(svc), nil)
+		if isKeyNotFound(err) {
+			resp = nil
+			return nil
+		}
+		return err
+	})
+	if err != nil || resp == nil || resp.Node == nil {
+		return err
+	}
+
+	existing, err := serviceFromNode(r.root(), r.codec, resp.Node)
+	if err != nil || existing.Hostname == "" || existing.Hostname == svc.Hostname {
+		return nil
+	}
+
+	logger().Warn("Service is already registered from another host", fields.with(Fields{
+		"hostname": svc.Hostname,
+		"existing": existing.Hostname,
+	}))
+	return fmt.Errorf("%w: %s is held by %s, not %s", ErrHostnameConflict, r.path(svc), existing.Hostname, svc.Hostname)
+}
+
+// IsRegistered reports whether a tcp service is registered on name and port,
+// with a single get of its key rather than a full enumeration.
+func (r *Registry) IsRegistered(name string, port int) (bool, error) {
+	if err := r.checkOpen(); err != nil {
+		return false, err
+	}
+
+	svc := &Service{Name: name, Port: port}
+	if err := svc.Validate(); err != nil {
+		return false, err
+	}
+
+	found := true
+	fields := Fields{
+		"action":  "IsRegistered",
+		"service": name,
+		"port":    port,
+	}
+	err := r.retry(context.Background(), "lookup", fields, func(ctx context.Context) error {
+		_, err := r.backend.Get(ctx, r.path(svc), nil)
+		if isKeyNotFound(err) {
+			found = false
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return found, nil
+}
+
+// Services returns an array of Service pointers detailing the service name and
+// port of each registered service. (from etcd)
+func (r *Registry) Services() ([]*Service, error) {
+	return r.ServicesContext(context.Background())
+}
+
+// ServicesContext is like Services but gives up as soon as ctx is done.
+// Services are sorted by Name, then Port, then Hostname, whatever order etcd
+// lists them in.
+func (r *Registry) ServicesContext(ctx context.Context) ([]*Service, error) {
+	if err := r.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	svcNodes, _, err := r.serviceNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]*Service, 0, len(svcNodes))
+	r.decodeServices(svcNodes, func(svc *Service) bool {
+		services = append(services, svc)
+		return true
+	})
+	sortServices(services)
+
+	return services, nil
+}
+
+// sortServices orders services by Name, Port, Hostname and then protocol, so
+// that listings are stable enough to diff.
+func sortServices(services []*Service) {
+	sort.Slice(services, func(i, j int) bool {
+		a, b := services[i], services[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		if a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		return a.protocol() < b.protocol()
+	})
+}
+
+// serviceNodes fetches the whole registry and returns its entries, without
+// decoding them, and the etcd index they were read at. An empty registry has
+// no entries.
+func (r *Registry) serviceNodes(ctx context.Context) (nodes client.Nodes, index uint64, err error) {
+	defer func() {
+		if err != nil {
+			r.hooks.failed("services", err)
+		}
+	}()
+
+	var (
+		resp  *client.Response
+		empty bool
+	)
+
+	// attempt to get the registry with exponential backoff
+	err = r.retry(ctx, "enumeration", Fields{"action": "Enumerate Services"}, func(ctx context.Context) error {
+		var err error
+		resp, err = r.backend.Get(ctx, r.root(), &client.GetOptions{Recursive: true, Sort: true})
+		if isKeyNotFound(err) {
+			// nothing has been registered yet
+			empty = true
+			index = err.(client.Error).Index
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if empty {
+		return nil, index, nil
+	}
+
+	// nothing to enumerate, like a missing node
+	if resp == nil {
+		logger().Warn("Nil response for etcd get, treating the registry as empty", Fields{
+			"action": "Enumerate Services",
+		})
+		return nil, 0, nil
+	}
+
+	return leaves(resp.Node, nil), resp.Index, nil
+}
+
+// decodeServices passes the service at each of nodes to yield, in order,
+// until yield returns false. Malformed entries are logged and skipped, and
+// only the first of several Equal entries is passed on.
+func (r *Registry) decodeServices(nodes client.Nodes, yield func(*Service) bool) {
+	seen := make(map[serviceID]bool, len(nodes))
+
+	for _, node := range nodes {
+		svc, err := serviceFromNode(r.root(), r.codec, node)
+		if err == nil {
+			err = svc.Validate()
+		}
+
+		// one bad entry shouldn't hide every other registration
+		if err != nil {
+			logger().Warn("Skipping malformed service entry", Fields{
+				"action": "Enumerate Services",
+				"key":    node.Key,
+				"errstr": err.Error(),
+			})
+			continue
+		}
+
+		// keep the first of any entries that are Equal
+		if seen[svc.id()] {
+			continue
+		}
+		seen[svc.id()] = true
+
+		if !yield(svc) {
+			return
+		}
+	}
+}
+
+// leaves appends the non-directory nodes below node to nodes, depth first.
+// Services live at name/protocol:port, below a directory per name. A nil
+// node, or a root that is itself a value, has none.
+func leaves(node *client.Node, nodes client.Nodes) client.Nodes {
+	if node == nil {
+		return nodes
+	}
+
+	for _, child := range node.Nodes {
+		if child == nil {
+			continue
+		}
+		if child.Dir {
+			nodes = leaves(child, nodes)
+		} else {
+			nodes = append(nodes, child)
+		}
+	}
+
+	return nodes
+}
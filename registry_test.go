@@ -0,0 +1,825 @@
+package portmapper
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_RegistryReusesKeysAPI(t *testing.T) {
+	var keys []string
+	kapi := &fakeKeysAPI{
+		set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+			keys = append(keys, key)
+			return &client.Response{}, nil
+		},
+		delete: func(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+			return &client.Response{}, nil
+		},
+	}
+	r := NewRegistry(kapi)
+
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.NoError(t, r.Register("serviceB", 2))
+	assert.NoError(t, r.Unregister("serviceA", 1))
+
+	assert.Equal(t, []string{RegistryPath + "/serviceA/tcp:1", RegistryPath + "/serviceB/tcp:2"}, keys)
+	assert.Equal(t, 2, kapi.sets)
+	assert.Equal(t, 1, kapi.deletes)
+}
+
+func Test_RegisterTTL(t *testing.T) {
+	var got *client.SetOptions
+	kapi := &fakeKeysAPI{
+		set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+			got = opts
+			return &client.Response{}, nil
+		},
+	}
+	defer useKeysAPI(kapi)()
+
+	assert.NoError(t, RegisterTTL("serviceA", 1, 30*time.Second))
+	if assert.NotNil(t, got) {
+		assert.Equal(t, 30*time.Second, got.TTL)
+	}
+}
+
+func Test_RetriesExhausted(t *testing.T) {
+	kapi := timeoutKeysAPI()
+	r := NewRegistry(kapi)
+
+	err := r.Register("serviceA", 1)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, MaxRetries, kapi.sets)
+
+	err = r.Unregister("serviceA", 1)
+	assert.Error(t, err)
+	assert.Equal(t, MaxRetries, kapi.deletes)
+
+	services, err := r.Services()
+	assert.Error(t, err)
+	assert.Nil(t, services)
+	assert.Equal(t, MaxRetries, kapi.gets)
+}
+
+func Test_RegisterWithTags(t *testing.T) {
+	var value string
+	kapi := &fakeKeysAPI{
+		set: func(ctx context.Context, key, v string, opts *client.SetOptions) (*client.Response, error) {
+			value = v
+			return &client.Response{}, nil
+		},
+	}
+	r := NewRegistry(kapi)
+
+	assert.NoError(t, r.RegisterWithTags("serviceA", 1, map[string]string{"env": "prod"}))
+	svc, err := UnmarshalService([]byte(value))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"env": "prod"}, svc.Tags)
+
+	assert.Error(t, r.RegisterWithTags("serviceA", 1, map[string]string{"port": "2"}))
+	assert.Equal(t, 1, kapi.sets)
+}
+
+func Test_RegistryPrefixesAreIsolated(t *testing.T) {
+	kapi := NewMemoryBackend()
+	tenantA := NewRegistryWithPrefix(kapi, "/tenants/a")
+	tenantB := NewRegistryWithPrefix(kapi, "/tenants/b")
+
+	assert.NoError(t, tenantA.Register("serviceA", 1))
+	assert.NoError(t, tenantB.Register("serviceA", 1))
+	assert.NoError(t, tenantB.Register("serviceB", 2))
+
+	_, err := kapi.Get(context.Background(), "/tenants/a/serviceA/tcp:1", nil)
+	assert.NoError(t, err)
+	_, err = kapi.Get(context.Background(), "/tenants/b/serviceA/tcp:1", nil)
+	assert.NoError(t, err)
+
+	services, err := tenantA.Services()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, "serviceA", services[0].Name)
+	}
+
+	services, err = tenantB.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(services))
+
+	assert.NoError(t, tenantA.Unregister("serviceA", 1))
+	services, err = tenantB.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(services))
+}
+
+func Test_ServicesWalksNestedNodes(t *testing.T) {
+	kapi := &fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		assert.True(t, opts.Recursive)
+		return &client.Response{Node: &client.Node{Key: key, Dir: true, Nodes: client.Nodes{
+			// entries from before the per-name directories
+			{Key: key + "/serviceA:1", Value: `{"name":"serviceA","port":1}`},
+			{Key: key + "/serviceB", Dir: true, Nodes: client.Nodes{
+				serviceNode(&Service{Name: "serviceB", Port: 2}),
+				serviceNode(&Service{Name: "serviceB", Port: 2, Protocol: ProtocolUDP}),
+			}},
+			{Key: key + "/empty", Dir: true},
+			{Key: key + "/deep", Dir: true, Nodes: client.Nodes{
+				{Key: key + "/deep/serviceC", Dir: true, Nodes: client.Nodes{
+					serviceNode(&Service{Name: "serviceC", Port: 3}),
+				}},
+			}},
+		}}}, nil
+	}}
+
+	services, err := NewRegistry(kapi).Services()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Service{
+		{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, SchemaVersion: 1},
+		{Name: "serviceB", Port: 2, Protocol: ProtocolTCP, SchemaVersion: 1},
+		{Name: "serviceB", Port: 2, Protocol: ProtocolUDP, SchemaVersion: 1},
+		{Name: "serviceC", Port: 3, Protocol: ProtocolTCP, SchemaVersion: 1},
+	}, services)
+}
+
+func Test_ServicesSkipsCorruptEntries(t *testing.T) {
+	kapi := NewMemoryBackend()
+	r := NewRegistry(kapi)
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.NoError(t, r.Register("serviceC", 3))
+
+	ctx := context.Background()
+	kapi.Set(ctx, RegistryPath+"/serviceB/tcp:2", "{not json", nil)
+	kapi.Set(ctx, RegistryPath+"/serviceD/tcp:4", "", nil)
+	kapi.Set(ctx, RegistryPath+"/serviceE/tcp:0", `{"name":"serviceE","port":0}`, nil)
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Equal(t, 3, len(services)) {
+		assert.Equal(t, "serviceA", services[0].Name)
+		assert.Equal(t, "serviceC", services[1].Name)
+		// an empty value is rebuilt from its key
+		assert.Equal(t, "serviceD", services[2].Name)
+	}
+}
+
+func Test_ServicesNilNodes(t *testing.T) {
+	shapes := map[string]*client.Node{
+		"nil node":       nil,
+		"leaf root":      {Key: RegistryPath, Value: `{"name":"serviceA","port":1}`},
+		"nil children":   {Key: RegistryPath, Dir: true},
+		"nil child":      {Key: RegistryPath, Dir: true, Nodes: client.Nodes{nil}},
+		"nil grandchild": {Key: RegistryPath, Dir: true, Nodes: client.Nodes{{Key: RegistryPath + "/serviceA", Dir: true, Nodes: client.Nodes{nil}}}},
+	}
+	for name, node := range shapes {
+		node := node
+		r := NewRegistry(&fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+			return &client.Response{Action: "get", Node: node}, nil
+		}})
+
+		services, err := r.Services()
+		assert.NoError(t, err, name)
+		assert.NotNil(t, services, name)
+		assert.Empty(t, services, name)
+		n, err := r.Count()
+		assert.NoError(t, err, name)
+		assert.Equal(t, 0, n, name)
+	}
+
+	// and so is no response at all
+	r := NewRegistry(&fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		return nil, nil
+	}})
+	services, err := r.Services()
+	assert.NoError(t, err)
+	assert.NotNil(t, services)
+	assert.Empty(t, services)
+	n, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func Test_ServicesDedupes(t *testing.T) {
+	kapi := &fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		return &client.Response{Node: &client.Node{Key: key, Dir: true, Nodes: client.Nodes{
+			{Key: key + "/serviceA:1", Value: `{"name":"serviceA","port":1,"hostname":"host1"}`},
+			serviceNode(&Service{Name: "serviceA", Port: 1, Hostname: "host1"}),
+			serviceNode(&Service{Name: "serviceA", Port: 1, Hostname: "host2"}),
+		}}}, nil
+	}}
+
+	services, err := NewRegistry(kapi).Services()
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(services)) {
+		assert.Equal(t, "host1", services[0].Hostname)
+		assert.Equal(t, "host2", services[1].Hostname)
+	}
+}
+
+func Test_IsRegistered(t *testing.T) {
+	kapi := NewMemoryBackend()
+	r := NewRegistry(kapi)
+	assert.NoError(t, r.Register("serviceA", 1))
+
+	registered, err := r.IsRegistered("serviceA", 1)
+	assert.NoError(t, err)
+	assert.True(t, registered)
+
+	registered, err = r.IsRegistered("serviceA", 2)
+	assert.NoError(t, err)
+	assert.False(t, registered)
+
+	failing := &fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		return nil, errors.New("etcd exploded")
+	}}
+	registered, err = NewRegistry(failing).IsRegistered("serviceA", 1)
+	assert.Error(t, err)
+	assert.False(t, registered)
+	assert.Equal(t, 1, failing.gets)
+}
+
+func Test_RegisterAllValidatesFirst(t *testing.T) {
+	kapi := NewMemoryBackend()
+	r := NewRegistry(kapi)
+
+	err := r.RegisterAll([]*Service{
+		{Name: "serviceA", Port: 1},
+		{Name: "serviceB", Port: 0},
+		{Name: "serviceC", Port: 3},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(kapi.entries))
+
+	assert.NoError(t, r.RegisterAll([]*Service{{Name: "serviceA", Port: 1}, {Name: "serviceC", Port: 3}}))
+	assert.Equal(t, 2, len(kapi.entries))
+
+	assert.Error(t, r.UnregisterAll([]*Service{{Name: "serviceA", Port: 1}, {Name: "", Port: 3}}))
+	assert.Equal(t, 2, len(kapi.entries))
+
+	assert.NoError(t, r.UnregisterAll([]*Service{{Name: "serviceA", Port: 1}, {Name: "serviceC", Port: 3}}))
+	assert.Equal(t, 0, len(kapi.entries))
+}
+
+func Test_RegisterAllPartialFailure(t *testing.T) {
+	mem := NewMemoryBackend()
+	kapi := &fakeKeysAPI{
+		set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+			if strings.Contains(key, "serviceB") {
+				return nil, errors.New("etcd exploded")
+			}
+			return mem.Set(ctx, key, value, opts)
+		},
+		delete: func(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+			if strings.Contains(key, "serviceA") {
+				return nil, errors.New("etcd exploded again")
+			}
+			return mem.Delete(ctx, key, opts)
+		},
+	}
+	r := NewRegistry(kapi)
+	services := []*Service{
+		{Name: "serviceA", Port: 1},
+		{Name: "serviceB", Port: 2},
+		{Name: "serviceC", Port: 3},
+	}
+
+	err := r.RegisterAll(services)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "etcd exploded")
+	}
+	assert.Equal(t, 3, kapi.sets)
+	assert.Equal(t, 2, len(mem.entries))
+
+	err = r.UnregisterAll(services)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "etcd exploded again")
+	}
+	assert.Equal(t, 1, len(mem.entries))
+}
+
+// noHostname makes localHostname come up empty until the returned func is
+// called.
+func noHostname(t *testing.T) func() {
+	t.Setenv("HOSTNAME", "")
+	orig := osHostname
+	osHostname = func() (string, error) { return "", errors.New("no hostname") }
+	return func() { osHostname = orig }
+}
+
+func Test_StrictValidationRequiresHostname(t *testing.T) {
+	defer noHostname(t)()
+
+	kapi := NewMemoryBackend()
+	assert.NoError(t, NewRegistry(kapi).Register("serviceA", 1))
+
+	strict := NewRegistry(kapi, WithStrictValidation())
+	assert.Error(t, strict.Register("serviceB", 2))
+	assert.Error(t, strict.RegisterAll([]*Service{{Name: "serviceC", Port: 3, Hostname: " "}}))
+	assert.NoError(t, strict.RegisterAll([]*Service{{Name: "serviceC", Port: 3, Hostname: "host1"}}))
+	assert.Equal(t, 2, len(kapi.entries))
+}
+
+func Test_StrictRegisterAllFillsHostname(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	t.Setenv("POMAPPER_REGION", "dc1")
+	mem := NewMemoryBackend()
+	r := NewRegistry(mem, WithStrictValidation())
+
+	services := []*Service{{Name: "serviceA", Port: 1}, {Name: "serviceB", Port: 2, Hostname: "host2"}}
+	assert.NoError(t, r.RegisterAll(services))
+	assert.Equal(t, "", services[0].Hostname)
+	assert.Equal(t, "", services[0].Region)
+
+	registered, err := r.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"serviceA:1/tcp@host1", "serviceB:2/tcp@host2"}, names(registered, nil))
+	assert.Equal(t, "dc1", registered[0].Region)
+
+	// as Register does
+	assert.NoError(t, r.Register("serviceC", 3))
+}
+
+func Test_RejectPrivilegedPorts(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	mem := NewMemoryBackend()
+
+	r := NewRegistry(mem, WithRejectPrivilegedPorts())
+	for _, port := range []int{1, 22, 80, 1023} {
+		err := r.Register("serviceA", port)
+		assert.True(t, errors.Is(err, ErrPrivilegedPort), "port %d: %v", port, err)
+	}
+	assert.True(t, errors.Is(r.RegisterPorts("serviceA", []int{8080, 443}), ErrPrivilegedPort))
+	assert.Empty(t, mem.entries)
+	assert.NoError(t, r.Register("serviceA", 1024))
+
+	// without the option, strict or not, privileged ports are fine
+	assert.NoError(t, NewRegistry(mem).Register("serviceB", 22))
+	assert.NoError(t, NewRegistry(mem, WithStrictValidation()).Register("serviceC", 443))
+	assert.Len(t, mem.entries, 3)
+
+	// and port 0 is invalid either way
+	err := r.Register("serviceD", 0)
+	assert.True(t, errors.Is(err, ErrInvalidPort))
+}
+
+func Test_RegisterWarnsWithoutHostname(t *testing.T) {
+	defer noHostname(t)()
+	capture := &captureLogger{}
+	defer useLogger(capture)()
+
+	warnings := func() []logEntry {
+		var warns []logEntry
+		for _, entry := range capture.entries {
+			if entry.level == "warn" {
+				warns = append(warns, entry)
+			}
+		}
+		return warns
+	}
+
+	r := NewRegistry(NewMemoryBackend())
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.NoError(t, r.Register("serviceB", 2))
+	if warns := warnings(); assert.Len(t, warns, 1) {
+		assert.Contains(t, warns[0].msg, "HOSTNAME")
+		assert.Equal(t, "serviceA", warns[0].fields["service"])
+	}
+
+	// nothing to warn about with a hostname
+	capture.entries = nil
+	assert.NoError(t, NewRegistry(NewMemoryBackend()).RegisterWithHostname("serviceA", 1, "host1"))
+	assert.Empty(t, warnings())
+}
+
+func Test_RegisterExclusive(t *testing.T) {
+	kapi := NewMemoryBackend()
+	r := NewRegistry(kapi)
+
+	assert.NoError(t, r.RegisterExclusive("serviceA", 1))
+
+	err := r.RegisterExclusive("serviceA", 1)
+	assert.True(t, errors.Is(err, ErrAlreadyRegistered))
+	assert.Contains(t, err.Error(), RegistryPath+"/serviceA/tcp:1")
+
+	// a different port is a different key
+	assert.NoError(t, r.RegisterExclusive("serviceA", 2))
+
+	// once the winner unregisters, the key can be claimed again
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	assert.NoError(t, r.RegisterExclusive("serviceA", 1))
+}
+
+func Test_RegistryClose(t *testing.T) {
+	kapi := NewMemoryBackend()
+	r := NewRegistry(kapi)
+
+	assert.NoError(t, r.RegisterWithKeepAlive(context.Background(), "serviceA", 1, time.Minute))
+	_, err := r.RegisterAndAutoUnregister(context.Background(), "serviceB", 2)
+	assert.NoError(t, err)
+	events, err := r.Watch(context.Background())
+	assert.NoError(t, err)
+
+	count, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Close waits for the background goroutines, which unregister on the way out
+	assert.NoError(t, r.Close())
+	_, open := <-events
+	assert.False(t, open)
+	assert.Equal(t, 0, len(kapi.entries))
+
+	assert.Equal(t, ErrClosed, r.Register("serviceC", 3))
+	assert.Equal(t, ErrClosed, r.Unregister("serviceC", 3))
+	_, err = r.Services()
+	assert.Equal(t, ErrClosed, err)
+	_, err = r.Watch(context.Background())
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, r.Ping(context.Background()))
+	assert.Equal(t, ErrClosed, r.RegisterWithKeepAlive(context.Background(), "serviceC", 3, time.Minute))
+
+	assert.NoError(t, r.Close())
+}
+
+func Test_RegisterWithHostname(t *testing.T) {
+	kapi := NewMemoryBackend()
+	r := NewRegistry(kapi)
+	t.Setenv("HOSTNAME", "envhost")
+
+	hostname := func(name string) string {
+		services, err := r.GetService(name)
+		assert.NoError(t, err)
+		if assert.Equal(t, 1, len(services)) {
+			return services[0].Hostname
+		}
+		return ""
+	}
+
+	// explicit
+	assert.NoError(t, r.RegisterWithHostname("serviceA", 1, "10.0.0.1"))
+	assert.Equal(t, "10.0.0.1", hostname("serviceA"))
+
+	// environment
+	assert.NoError(t, r.RegisterWithHostname("serviceB", 2, ""))
+	assert.Equal(t, "envhost", hostname("serviceB"))
+
+	// kernel hostname
+	t.Setenv("HOSTNAME", "")
+	orig := osHostname
+	defer func() { osHostname = orig }()
+	osHostname = func() (string, error) { return "kernelhost", nil }
+	assert.NoError(t, r.RegisterWithHostname("serviceC", 3, " "))
+	assert.Equal(t, "kernelhost", hostname("serviceC"))
+	assert.NoError(t, r.Register("serviceD", 4))
+	assert.Equal(t, "kernelhost", hostname("serviceD"))
+}
+
+func Test_RegisterWithAddress(t *testing.T) {
+	t.Setenv("HOSTNAME", "c0ffee")
+	r := NewRegistry(NewMemoryBackend())
+
+	assert.NoError(t, r.RegisterWithAddress("serviceA", 1, "10.0.0.1"))
+	assert.Error(t, r.RegisterWithAddress("serviceB", 2, "not-an-ip"))
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Service{{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "c0ffee", Address: "10.0.0.1", SchemaVersion: 1, ModifiedIndex: 1}}, services)
+}
+
+func Test_Refresh(t *testing.T) {
+	kapi := NewMemoryBackend()
+	r := NewRegistry(kapi)
+
+	svc := &Service{Name: "serviceA", Port: 1, Hostname: "host1", Tags: map[string]string{"version": "1"}}
+	assert.NoError(t, r.RegisterAll([]*Service{svc}))
+
+	svc.Tags = map[string]string{"version": "2"}
+	svc.Address = "10.0.0.1"
+	assert.NoError(t, r.Refresh(svc))
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, "2", services[0].Tags["version"])
+		assert.Equal(t, "10.0.0.1", services[0].Address)
+	}
+
+	// a deleted entry is not brought back
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	err = r.Refresh(svc)
+	assert.True(t, errors.Is(err, ErrNotRegistered))
+	assert.Equal(t, 0, len(kapi.entries))
+}
+
+func Test_RefreshKeepsTTL(t *testing.T) {
+	kapi := NewMemoryBackend()
+	r := NewRegistry(kapi)
+	assert.NoError(t, r.RegisterTTL("serviceA", 1, time.Minute))
+	key := RegistryPath + "/serviceA/tcp:1"
+
+	// this registry's own entry keeps the TTL it was made with
+	assert.NoError(t, r.Refresh(&Service{Name: "serviceA", Port: 1, Address: "10.0.0.1"}))
+	assert.False(t, kapi.entries[key].expires.IsZero())
+	reg, ok := r.ownedAt(key)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, reg.ttl)
+
+	// and anyone else's keeps the time it has left
+	other := NewRegistry(kapi)
+	assert.NoError(t, other.Refresh(&Service{Name: "serviceA", Port: 1, Address: "10.0.0.2"}))
+	if expires := kapi.entries[key].expires; assert.False(t, expires.IsZero()) {
+		assert.WithinDuration(t, time.Now().Add(time.Minute), expires, 5*time.Second)
+	}
+}
+
+func Test_UnregisterService(t *testing.T) {
+	kapi := NewMemoryBackend()
+	r := NewRegistry(kapi)
+
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.NoError(t, r.Register("serviceA", 2))
+	assert.NoError(t, r.RegisterAll([]*Service{{Name: "serviceA", Port: 53, Protocol: ProtocolUDP}}))
+	assert.NoError(t, r.Register("serviceAB", 3))
+	kapi.Set(context.Background(), RegistryPath+"/serviceA:4", `{"name":"serviceA","port":4}`, nil)
+
+	n, err := r.UnregisterService("serviceA")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, "serviceAB", services[0].Name)
+	}
+
+	n, err = r.UnregisterService("serviceA")
+	assert.True(t, errors.Is(err, ErrNotRegistered))
+	assert.Equal(t, 0, n)
+
+	_, err = r.UnregisterService("")
+	assert.True(t, errors.Is(err, ErrMissingName))
+	assert.Equal(t, 1, len(kapi.entries))
+}
+
+func Test_ServicesModifiedIndex(t *testing.T) {
+	svcA := &Service{Name: "serviceA", Port: 1, Hostname: "host1"}
+	svcB := &Service{Name: "serviceB", Port: 2, Hostname: "host1"}
+	r := NewRegistry(&fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		nodeA, nodeB := serviceNode(svcA), serviceNode(svcB)
+		nodeA.ModifiedIndex, nodeB.ModifiedIndex = 7, 42
+		return &client.Response{Node: &client.Node{Key: key, Dir: true, Nodes: client.Nodes{
+			{Key: key + "/serviceA", Dir: true, Nodes: client.Nodes{nodeA}},
+			{Key: key + "/serviceB", Dir: true, Nodes: client.Nodes{nodeB}},
+		}}}, nil
+	}})
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(services)) {
+		assert.Equal(t, uint64(7), services[0].ModifiedIndex)
+		assert.Equal(t, uint64(42), services[1].ModifiedIndex)
+	}
+
+	services, err = r.GetService("serviceB")
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(services)) {
+		assert.Equal(t, uint64(42), services[0].ModifiedIndex)
+
+		// the index never makes it into the stored value
+		bytes, err := services[0].Marshal()
+		assert.NoError(t, err)
+		assert.NotContains(t, string(bytes), "42")
+		svc, err := UnmarshalService([]byte(`{"name":"serviceB","port":2,"ModifiedIndex":42}`))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), svc.ModifiedIndex)
+	}
+}
+
+func Test_RegisterPorts(t *testing.T) {
+	mem := NewMemoryBackend()
+	r := NewRegistry(mem)
+
+	assert.NoError(t, r.RegisterPorts("serviceA", []int{80, 443}))
+	assert.Equal(t, 2, len(mem.entries))
+
+	// an invalid port means nothing is written
+	assert.True(t, errors.Is(r.RegisterPorts("serviceB", []int{80, 0}), ErrInvalidPort))
+	assert.Equal(t, 2, len(mem.entries))
+}
+
+func Test_RegisterPortsRollsBack(t *testing.T) {
+	mem := NewMemoryBackend()
+	kapi := &fakeKeysAPI{
+		set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+			if strings.HasSuffix(key, ":8443") {
+				return nil, errors.New("etcd exploded")
+			}
+			return mem.Set(ctx, key, value, opts)
+		},
+		get:    mem.Get,
+		delete: mem.Delete,
+	}
+	r := NewRegistry(kapi)
+
+	err := r.RegisterPorts("serviceA", []int{80, 443, 8443, 9000})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "etcd exploded")
+	}
+	assert.Equal(t, 3, kapi.sets)
+	assert.Equal(t, 2, kapi.deletes)
+	assert.Equal(t, 0, len(mem.entries))
+
+	// a failed rollback is reported too
+	kapi.delete = func(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+		return nil, errors.New("etcd exploded again")
+	}
+	err = r.RegisterPorts("serviceA", []int{80, 8443})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rolling back port 80")
+	}
+}
+
+func Test_RegisterPortsKeepsExisting(t *testing.T) {
+	mem := NewMemoryBackend()
+	kapi := &fakeKeysAPI{
+		set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+			if strings.HasSuffix(key, ":8443") {
+				return nil, errors.New("etcd exploded")
+			}
+			return mem.Set(ctx, key, value, opts)
+		},
+		get:    mem.Get,
+		delete: mem.Delete,
+	}
+	r := NewRegistry(kapi)
+	assert.NoError(t, r.Register("serviceA", 80))
+
+	// a port registered before the call survives its rollback
+	assert.Error(t, r.RegisterPorts("serviceA", []int{80, 443, 8443}))
+	assert.Equal(t, 1, kapi.deletes)
+	found, err := r.IsRegistered("serviceA", 80)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = r.IsRegistered("serviceA", 443)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func Test_ConflictCheck(t *testing.T) {
+	mem := NewMemoryBackend()
+	assert.NoError(t, NewRegistry(mem).RegisterWithHostname("serviceA", 1, "host1"))
+
+	// without the check the later registration wins
+	assert.NoError(t, NewRegistry(mem).RegisterWithHostname("serviceA", 1, "host2"))
+	assert.NoError(t, NewRegistry(mem).RegisterWithHostname("serviceA", 1, "host1"))
+
+	for _, r := range []*Registry{
+		NewRegistry(mem, WithConflictCheck()),
+		NewRegistry(mem, WithStrictValidation()),
+	} {
+		err := r.RegisterWithHostname("serviceA", 1, "host2")
+		assert.True(t, errors.Is(err, ErrHostnameConflict))
+		assert.Contains(t, err.Error(), "host1")
+
+		// the owner can re-register, and other ports are free
+		assert.NoError(t, r.RegisterWithHostname("serviceA", 1, "host1"))
+		assert.NoError(t, r.RegisterWithHostname("serviceA", 2, "host2"))
+	}
+
+	services, err := NewRegistry(mem).GetService("serviceA")
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(services)) {
+		assert.Equal(t, "host1", services[0].Hostname)
+	}
+}
+
+func Test_UnregisterMissingKey(t *testing.T) {
+	unregistered := make(chan *Service, 1)
+	r := NewInMemoryRegistry(WithHooks(Hooks{OnUnregister: func(svc *Service) { unregistered <- svc }}))
+
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	select {
+	case svc := <-unregistered:
+		t.Fatalf("OnUnregister called for %v", svc)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// other errors still fail
+	denied := client.Error{Code: client.ErrorCodeUnauthorized, Message: "The request requires user authentication"}
+	r = NewRegistry(&fakeKeysAPI{delete: func(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+		return nil, denied
+	}})
+	assert.Equal(t, denied, r.Unregister("serviceA", 1))
+}
+
+func Test_UnregisterInstance(t *testing.T) {
+	backend := NewMemoryBackend()
+	r := NewRegistry(backend)
+	udp := &Service{Name: "serviceA", Port: 53, Protocol: ProtocolUDP}
+	assert.NoError(t, r.RegisterAll([]*Service{udp, {Name: "serviceA", Port: 53}}))
+
+	// the name and port alone would pick the tcp entry
+	assert.NoError(t, r.UnregisterInstance(udp))
+	_, ok := backend.entries[RegistryPath+"/serviceA/udp:53"]
+	assert.False(t, ok)
+	_, ok = backend.entries[RegistryPath+"/serviceA/tcp:53"]
+	assert.True(t, ok)
+
+	assert.NoError(t, r.UnregisterInstance(udp))
+	assert.ErrorIs(t, r.UnregisterInstance(&Service{Name: "serviceA", Port: 53, Protocol: "sctp"}), ErrInvalidProtocol)
+}
+
+func Test_ServicesSorted(t *testing.T) {
+	kapi := &fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceB", Port: 1, Hostname: "host1"},
+		&Service{Name: "serviceA", Port: 10, Hostname: "host1"},
+		&Service{Name: "serviceA", Port: 2, Hostname: "host2"},
+		&Service{Name: "serviceA", Port: 2, Hostname: "host1", Protocol: ProtocolUDP},
+		&Service{Name: "serviceA", Port: 2, Hostname: "host1"},
+	)}
+
+	services, err := NewRegistry(kapi).Services()
+	assert.NoError(t, err)
+
+	var got []string
+	for _, svc := range services {
+		got = append(got, svc.String())
+	}
+	assert.Equal(t, []string{
+		"serviceA:2/tcp@host1",
+		"serviceA:2/udp@host1",
+		"serviceA:2/tcp@host2",
+		"serviceA:10/tcp@host1",
+		"serviceB:1/tcp@host1",
+	}, got)
+}
+
+func Test_ReadOnlyRegistry(t *testing.T) {
+	// set and delete aren't stubbed, so any write would panic
+	kapi := &fakeKeysAPI{
+		get: registryGet(&Service{Name: "serviceA", Port: 1, Hostname: "host1"}),
+		watcher: func(key string, opts *client.WatcherOptions) client.Watcher {
+			return &fakeWatcher{}
+		},
+	}
+	r := NewRegistry(kapi, WithReadOnly())
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Equal(t, ErrReadOnly, r.Register("serviceB", 2))
+	assert.Equal(t, ErrReadOnly, r.RegisterTTL("serviceB", 2, time.Minute))
+	assert.Equal(t, ErrReadOnly, r.RegisterWithKeepAlive(ctx, "serviceB", 2, time.Minute))
+	assert.Equal(t, ErrReadOnly, r.Refresh(&Service{Name: "serviceA", Port: 1}))
+	assert.Equal(t, ErrReadOnly, r.RegisterAll([]*Service{{Name: "serviceB", Port: 2}}))
+	assert.Equal(t, ErrReadOnly, r.RegisterPorts("serviceB", []int{2, 3}))
+	assert.Equal(t, ErrReadOnly, r.Unregister("serviceA", 1))
+	assert.Equal(t, ErrReadOnly, r.UnregisterInstance(&Service{Name: "serviceA", Port: 1}))
+	assert.Equal(t, ErrReadOnly, r.UnregisterAll([]*Service{{Name: "serviceA", Port: 1}}))
+	_, err := r.UnregisterService("serviceA")
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, ErrReadOnly, r.Drain("serviceA", 1))
+	_, err = r.DeregisterStale(ctx, func(*Service) bool { return false })
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, 0, kapi.gets)
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(services))
+	_, err = r.Watch(ctx)
+	assert.NoError(t, err)
+}
+
+func Test_DryRunRegistry(t *testing.T) {
+	var writes int
+	hooks := Hooks{
+		OnRegister:   func(*Service) { writes++ },
+		OnUnregister: func(*Service) { writes++ },
+	}
+	// set and delete aren't stubbed, so any write would panic
+	kapi := &fakeKeysAPI{
+		get: registryGet(&Service{Name: "serviceA", Port: 1, Hostname: "host1"}),
+	}
+	r := NewRegistry(kapi, WithDryRun(), WithHooks(hooks))
+
+	assert.NoError(t, r.Register("serviceB", 2))
+	assert.NoError(t, r.RegisterTTL("serviceB", 2, time.Minute))
+	assert.NoError(t, r.RegisterAll([]*Service{{Name: "serviceB", Port: 2}}))
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	n, err := r.UnregisterService("serviceA")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = r.DeregisterStale(context.Background(), func(*Service) bool { return false })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 0, writes)
+
+	// validation still runs
+	assert.ErrorIs(t, r.Register("", 1), ErrMissingName)
+	assert.ErrorIs(t, r.Unregister("serviceA", 0), ErrInvalidPort)
+	assert.Equal(t, 0, kapi.sets+kapi.deletes)
+}
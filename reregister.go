@@ -0,0 +1,112 @@
+package portmapper
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// registration is a service the registry has written and not since deleted,
+// with the TTL it was written with.
+type registration struct {
+	svc *Service
+	ttl time.Duration
+}
+
+// own records that svc was written at its key with opts.
+func (r *Registry) own(svc *Service, opts *client.SetOptions) {
+	reg := registration{svc: svc.Clone()}
+	if opts != nil {
+		reg.ttl = opts.TTL
+	}
+
+	r.ownMu.Lock()
+	defer r.ownMu.Unlock()
+
+	if r.owned == nil {
+		r.owned = map[string]registration{}
+	}
+	r.owned[r.path(svc)] = reg
+}
+
+// ownedAt returns the registration owned at path, if there still is
+// one.
+func (r *Registry) ownedAt(path string) (registration, bool) {
+	r.ownMu.Lock()
+	defer r.ownMu.Unlock()
+
+	reg, ok := r.owned[path]
+	return reg, ok
+}
+
+// drainOwned marks the registration owned at path, if there is one, as
+// Draining, so that Reregister doesn't write it back undrained.
+func (r *Registry) drainOwned(path string) {
+	r.ownMu.Lock()
+	defer r.ownMu.Unlock()
+
+	if reg, ok := r.owned[path]; ok {
+		reg.svc = reg.svc.Clone()
+		reg.svc.Draining = true
+		r.owned[path] = reg
+	}
+}
+
+// disown forgets the registrations at key and below it.
+func (r *Registry) disown(key string) {
+	r.ownMu.Lock()
+	defer r.ownMu.Unlock()
+
+	for path := range r.owned {
+		if path == key || strings.HasPrefix(path, key+"/") {
+			delete(r.owned, path)
+		}
+	}
+}
+
+// Reregister writes every service this registry has registered, and not
+// since unregistered, back to etcd, each with the TTL it was first written
+// with. It is for recovering from etcd losing its data, for instance after
+// a restart without persistence or a watch reset. It can also run on a
+// timer, though watchers see every rewritten entry as modified. Failures
+// are returned together after every service has been tried.
+func (r *Registry) Reregister() error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+
+	r.ownMu.Lock()
+	paths := make([]string, 0, len(r.owned))
+	for path := range r.owned {
+		paths = append(paths, path)
+	}
+	r.ownMu.Unlock()
+	sort.Strings(paths)
+
+	var errs []error
+	written := 0
+	for _, path := range paths {
+		// look again right before writing, so that anything unregistered
+		// in the meantime isn't written back
+		reg, ok := r.ownedAt(path)
+		if !ok {
+			continue
+		}
+		if err := r.register(context.Background(), reg.svc, &client.SetOptions{TTL: reg.ttl}); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		written++
+	}
+
+	logger().Info("Reregistered services with etcd", Fields{
+		"action": "Reregister",
+		"count":  written,
+		"failed": len(errs),
+	})
+	return errors.Join(errs...)
+}
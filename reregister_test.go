@@ -0,0 +1,116 @@
+package portmapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_Reregister(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	r := NewInMemoryRegistry()
+	defer r.Close()
+
+	assert.NoError(t, r.RegisterWithTags("serviceA", 1, map[string]string{"env": "prod"}))
+	assert.NoError(t, r.RegisterTTL("serviceA", 2, time.Minute))
+	assert.NoError(t, r.Register("serviceB", 3))
+	assert.NoError(t, r.Register("serviceC", 4))
+	assert.NoError(t, r.Register("serviceC", 5))
+	assert.NoError(t, r.Drain("serviceB", 3))
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	_, err := r.UnregisterService("serviceC")
+	assert.NoError(t, err)
+	assert.NoError(t, r.RegisterWithTags("serviceA", 1, map[string]string{"env": "dev"}))
+	before, err := r.Services()
+	assert.NoError(t, err)
+
+	// etcd comes back empty
+	_, err = r.backend.Delete(context.Background(), r.root(), &client.DeleteOptions{Recursive: true})
+	assert.NoError(t, err)
+	services, err := r.Services()
+	assert.NoError(t, err)
+	assert.Empty(t, services)
+
+	assert.NoError(t, r.Reregister())
+	services, err = r.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"serviceA:1/tcp@host1", "serviceA:2/tcp@host1", "serviceB:3/tcp@host1"}, names(services, nil))
+	for i := range services {
+		assert.True(t, services[i].Equal(before[i]), "%v", services[i])
+	}
+
+	// the TTL entry expires again
+	resp, err := r.backend.Get(context.Background(), r.Key(&Service{Name: "serviceA", Port: 2}), nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp.Node.Expiration)
+
+	// rewriting intact entries is harmless
+	assert.NoError(t, r.Reregister())
+	count, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	r.Close()
+	assert.Equal(t, ErrClosed, r.Reregister())
+}
+
+func Test_ReregisterReportsFailures(t *testing.T) {
+	_, restore := countWaits()
+	defer restore()
+
+	kapi := &fakeKeysAPI{set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+		return &client.Response{}, nil
+	}}
+	r := NewRegistry(kapi)
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.NoError(t, r.Register("serviceB", 2))
+
+	kapi.set = func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+		return nil, context.DeadlineExceeded
+	}
+	err := r.Reregister()
+	assert.Error(t, err)
+	assert.Equal(t, 2+2*MaxRetries, kapi.sets)
+}
+
+// onSet is a Backend that calls fn before each set.
+type onSet struct {
+	Backend
+	fn func(key string)
+}
+
+func (b *onSet) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	if b.fn != nil {
+		b.fn(key)
+	}
+	return b.Backend.Set(ctx, key, value, opts)
+}
+
+func Test_ReregisterSkipsUnregistered(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	backend := &onSet{Backend: NewMemoryBackend()}
+	r := NewRegistry(backend)
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.NoError(t, r.Register("serviceB", 2))
+
+	// serviceB is unregistered while serviceA is being rewritten
+	var written []string
+	backend.fn = func(key string) {
+		written = append(written, key)
+		if key == r.Key(&Service{Name: "serviceA", Port: 1}) {
+			assert.NoError(t, r.Unregister("serviceB", 2))
+		}
+	}
+	assert.NoError(t, r.Reregister())
+	assert.Equal(t, []string{RegistryPath + "/serviceA/tcp:1"}, written)
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"serviceA:1/tcp@host1"}, names(services, nil))
+	r.ownMu.Lock()
+	assert.Len(t, r.owned, 1)
+	r.ownMu.Unlock()
+}
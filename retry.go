@@ -0,0 +1,300 @@
+package portmapper
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RetryPolicy controls how a Registry retries etcd requests that time out.
+type RetryPolicy struct {
+	// MaxRetries is the number of attempts made before giving up. Zero or
+	// less makes a single attempt, as does WithFailFast.
+	MaxRetries int
+	// Timeout bounds each attempt.
+	Timeout time.Duration
+	// BackoffBase is the wait after the first failed attempt. It doubles
+	// after every further failure.
+	BackoffBase time.Duration
+	// MaxBackoff caps any single wait. Zero means DefaultMaxBackoff.
+	MaxBackoff time.Duration
+	// MaxElapsed bounds a whole operation, every attempt and wait included.
+	// Zero leaves it bounded only by the caller's context, if any.
+	MaxElapsed time.Duration
+
+	// DisableJitter makes every wait exactly the exponential delay. By
+	// default each wait is drawn from the upper half of it, so instances
+	// that fail together don't all retry in lockstep.
+	DisableJitter bool
+	// Rand is the source of jitter, for deterministic tests. It must not be
+	// shared between goroutines. Nil uses math/rand's global source.
+	Rand *rand.Rand
+
+	// Backoff, if set, chooses every wait in place of BackoffBase,
+	// MaxBackoff, DisableJitter and Rand.
+	Backoff Backoff
+}
+
+// Backoff decides how long to wait between attempts. NextDelay is called
+// with 0 for the wait after the first failed attempt, 1 after the second and
+// so on.
+type Backoff interface {
+	NextDelay(attempt int) time.Duration
+}
+
+// BackoffFunc adapts a function to a Backoff, for strategies such as
+// decorrelated jitter that the types here don't cover.
+type BackoffFunc func(attempt int) time.Duration
+
+func (f BackoffFunc) NextDelay(attempt int) time.Duration {
+	return f(attempt)
+}
+
+// ConstantBackoff waits Delay between every pair of attempts.
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+func (b ConstantBackoff) NextDelay(attempt int) time.Duration {
+	return b.Delay
+}
+
+// LinearBackoff waits Step after the first failed attempt and one Step more
+// after each further failure, up to Max. Zero Max means DefaultMaxBackoff.
+type LinearBackoff struct {
+	Step time.Duration
+	Max  time.Duration
+}
+
+func (b LinearBackoff) NextDelay(attempt int) time.Duration {
+	max := b.Max
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+
+	if b.Step <= 0 {
+		return 0
+	}
+	// compare before multiplying so a large attempt can't overflow
+	if time.Duration(attempt) >= max/b.Step {
+		return max
+	}
+	return b.Step * time.Duration(attempt+1)
+}
+
+// ExponentialBackoff waits Base after the first failed attempt, doubling
+// after each further failure up to Max, which zero makes DefaultMaxBackoff.
+// Unless DisableJitter is set each wait is drawn from the upper half of that,
+// using Rand if it isn't nil. It is what a RetryPolicy without a Backoff
+// uses.
+type ExponentialBackoff struct {
+	Base          time.Duration
+	Max           time.Duration
+	DisableJitter bool
+	Rand          *rand.Rand
+}
+
+// DefaultMaxBackoff is the longest a Registry waits between two attempts
+// unless its RetryPolicy sets MaxBackoff.
+const DefaultMaxBackoff = 5 * time.Second
+
+// DefaultRetryPolicy returns the policy used by registries created without
+// WithRetryPolicy, built from MaxRetries and RequestTimeoutSec.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:  MaxRetries,
+		Timeout:     RequestTimeoutSec * time.Second,
+		BackoffBase: 2 * time.Millisecond,
+		MaxBackoff:  DefaultMaxBackoff,
+	}
+}
+
+// NextDelay returns a random duration in [d/2, d] where d is Base << attempt
+// capped at Max, or d itself when jitter is disabled.
+func (b ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	max := b.Max
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+
+	// shift one doubling at a time so a large attempt can't overflow
+	d := b.Base
+	for i := 0; i < attempt && d < max; i++ {
+		d <<= 1
+	}
+	if d > max || d < 0 {
+		d = max
+	}
+
+	if b.DisableJitter || d <= 1 {
+		return d
+	}
+
+	half := d / 2
+	n := int64(d-half) + 1
+	if b.Rand != nil {
+		return half + time.Duration(b.Rand.Int63n(n))
+	}
+	return half + time.Duration(rand.Int63n(n))
+}
+
+// delay returns how long to wait after failed attempt try, from the policy's
+// Backoff or else its exponential settings.
+func (p RetryPolicy) delay(try int) time.Duration {
+	if p.Backoff != nil {
+		return p.Backoff.NextDelay(try)
+	}
+
+	return ExponentialBackoff{
+		Base:          p.BackoffBase,
+		Max:           p.MaxBackoff,
+		DisableJitter: p.DisableJitter,
+		Rand:          p.Rand,
+	}.NextDelay(try)
+}
+
+// attempts returns how many attempts the policy allows, which is never less
+// than one.
+func (p RetryPolicy) attempts() int {
+	if p.MaxRetries < 1 {
+		return 1
+	}
+	return p.MaxRetries
+}
+
+// WithFailFast makes the Registry give up after a single attempt at each
+// etcd request, with no backoff, for interactive use where an immediate
+// error beats waiting out the retries. The rest of the retry policy, from
+// WithRetryPolicy if that is given too, still applies.
+func WithFailFast() Option {
+	return func(r *Registry) {
+		r.failFast = true
+	}
+}
+
+// retryPolicy returns the policy the registry was created with, or the
+// default one, limited to one attempt under WithFailFast.
+func (r *Registry) retryPolicy() RetryPolicy {
+	p := DefaultRetryPolicy()
+	if r.policy != nil {
+		p = *r.policy
+	}
+	if r.failFast {
+		p.MaxRetries = 1
+	}
+	return p
+}
+
+// wait is the backoff between attempts, replaceable in tests.
+var wait = backoff
+
+// backoff waits for d, returning early with ctx's error if it is done first.
+func backoff(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// RetryError is returned when every attempt at an operation timed out. It
+// wraps the last attempt's error.
+type RetryError struct {
+	// Op names the operation, such as "registration".
+	Op string
+	// AttemptCount is how many attempts were made.
+	AttemptCount int
+	// TotalElapsed is the time from the first attempt to giving up, waits
+	// included.
+	TotalElapsed time.Duration
+	Err          error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("service %s failed after %d attempts in %v: %v", e.Op, e.AttemptCount, e.TotalElapsed, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// retry calls fn with a per-attempt timeout derived from ctx until it
+// succeeds, fails with anything other than a timeout, or the retry policy's
+// attempts have all timed out, which is reported as a RetryError. A deadline
+// on ctx, or the policy's MaxElapsed, cuts the whole loop short, as does
+// running out of retry budget. An open circuit breaker stops the loop before
+// it starts. what names the operation in log messages and errors.
+func (r *Registry) retry(ctx context.Context, what string, fields Fields, fn func(context.Context) error) (err error) {
+	parent := ctx
+	start := time.Now()
+	policy := r.retryPolicy()
+	if len(r.endpoints) > 0 {
+		fields = fields.with(Fields{"endpoints": strings.Join(r.endpoints, ",")})
+	}
+
+	if policy.MaxElapsed > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.MaxElapsed)
+		defer cancel()
+	}
+
+	if r.budget != nil && !r.budget.available() {
+		logger().Warn("Service "+what+" not attempted, retry budget exhausted.", fields)
+		return exhausted(what, 0, nil)
+	}
+	if r.breaker != nil {
+		ok, probe := r.breaker.allow()
+		if !ok {
+			logger().Warn("Service "+what+" not attempted, circuit breaker open.", fields)
+			return fmt.Errorf("service %s not attempted: %w", what, ErrCircuitOpen)
+		}
+		defer func() { r.breaker.done(parent, probe, err) }()
+	}
+
+	attempts := policy.attempts()
+	for try := 0; try < attempts; try++ {
+		reqCtx, cancel := context.WithTimeout(ctx, policy.Timeout)
+		err = fn(reqCtx)
+		cancel()
+
+		if err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		} else if err == context.DeadlineExceeded {
+			logger().Warn("Service "+what+" exceeded context deadline. Retrying", fields.with(Fields{
+				"attempt": try,
+				"errstr":  err.Error(),
+			}))
+		} else {
+			logger().Error("Service "+what+" failed.", fields.with(Fields{"errstr": err.Error()}))
+			return err
+		}
+
+		// only wait if there is another attempt to wait for
+		if try == attempts-1 {
+			break
+		}
+		if r.budget != nil && !r.budget.take() {
+			logger().Error("Service "+what+" failed, retry budget exhausted.", fields.with(Fields{"attempts": try + 1}))
+			return exhausted(what, try+1, err)
+		}
+		if err := wait(ctx, policy.delay(try)); err != nil {
+			return err
+		}
+	}
+
+	rerr := &RetryError{Op: what, AttemptCount: attempts, TotalElapsed: time.Since(start), Err: err}
+	logger().Error("Service "+what+" failed after all retries.", fields.with(Fields{
+		"attempts": rerr.AttemptCount,
+		"elapsed":  rerr.TotalElapsed.String(),
+	}))
+	return rerr
+}
@@ -0,0 +1,296 @@
+package portmapper
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// timeoutKeysAPI returns a fake whose every request times out.
+func timeoutKeysAPI() *fakeKeysAPI {
+	return &fakeKeysAPI{
+		get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+			return nil, context.DeadlineExceeded
+		},
+		set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+			return nil, context.DeadlineExceeded
+		},
+		delete: func(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+			return nil, context.DeadlineExceeded
+		},
+	}
+}
+
+func Test_RetryPolicySingleAttempt(t *testing.T) {
+	kapi := timeoutKeysAPI()
+	r := NewRegistry(kapi, WithRetryPolicy(RetryPolicy{MaxRetries: 1, Timeout: time.Second, BackoffBase: time.Millisecond}))
+
+	assert.Error(t, r.Register("serviceA", 1))
+	assert.Equal(t, 1, kapi.sets)
+	assert.Error(t, r.Unregister("serviceA", 1))
+	assert.Equal(t, 1, kapi.deletes)
+	_, err := r.Services()
+	assert.Error(t, err)
+	assert.Equal(t, 1, kapi.gets)
+}
+
+func Test_RetryFailFast(t *testing.T) {
+	waits, restore := countWaits()
+	defer restore()
+
+	for _, opt := range []Option{
+		WithFailFast(),
+		WithRetryPolicy(RetryPolicy{MaxRetries: 0, Timeout: time.Second}),
+	} {
+		kapi := timeoutKeysAPI()
+		err := NewRegistry(kapi, opt).Register("serviceA", 1)
+
+		var rerr *RetryError
+		if assert.True(t, errors.As(err, &rerr)) {
+			assert.Equal(t, 1, rerr.AttemptCount)
+			assert.Equal(t, context.DeadlineExceeded, rerr.Err)
+		}
+		assert.Equal(t, 1, kapi.sets)
+	}
+	assert.Equal(t, 0, *waits)
+
+	// fail fast keeps the rest of the policy, whichever option comes first
+	policy := RetryPolicy{MaxRetries: 5, Timeout: time.Millisecond}
+	for _, opts := range [][]Option{
+		{WithRetryPolicy(policy), WithFailFast()},
+		{WithFailFast(), WithRetryPolicy(policy)},
+	} {
+		r := NewRegistry(timeoutKeysAPI(), opts...)
+		assert.Equal(t, RetryPolicy{MaxRetries: 1, Timeout: time.Millisecond}, r.retryPolicy())
+	}
+}
+
+func Test_RetryPolicyDelay(t *testing.T) {
+	def := DefaultRetryPolicy()
+	assert.Equal(t, MaxRetries, def.MaxRetries)
+	assert.Equal(t, RequestTimeoutSec*time.Second, def.Timeout)
+
+	def.DisableJitter = true
+	assert.Equal(t, 2*time.Millisecond, def.delay(0))
+	assert.Equal(t, 4*time.Millisecond, def.delay(1))
+	assert.Equal(t, 8*time.Millisecond, def.delay(2))
+
+	custom := RetryPolicy{BackoffBase: 10 * time.Millisecond, DisableJitter: true}
+	assert.Equal(t, 10*time.Millisecond, custom.delay(0))
+	assert.Equal(t, 20*time.Millisecond, custom.delay(1))
+	assert.Equal(t, 40*time.Millisecond, custom.delay(2))
+}
+
+func Test_RetryPolicyJitter(t *testing.T) {
+	p := RetryPolicy{BackoffBase: 10 * time.Millisecond, Rand: rand.New(rand.NewSource(1))}
+
+	seen := map[time.Duration]bool{}
+	for try := 0; try < 8; try++ {
+		d := p.BackoffBase << uint(try)
+		for i := 0; i < 50; i++ {
+			got := p.delay(try)
+			assert.True(t, got >= d/2 && got <= d, "delay %v for attempt %d outside [%v, %v]", got, try, d/2, d)
+			seen[got] = true
+		}
+	}
+	assert.True(t, len(seen) > 8, "jittered delays should vary")
+
+	// the same seed gives the same delays
+	a := RetryPolicy{BackoffBase: 10 * time.Millisecond, Rand: rand.New(rand.NewSource(42))}
+	b := RetryPolicy{BackoffBase: 10 * time.Millisecond, Rand: rand.New(rand.NewSource(42))}
+	for try := 0; try < 8; try++ {
+		assert.Equal(t, a.delay(try), b.delay(try))
+	}
+}
+
+func Test_RetryPolicyMaxBackoff(t *testing.T) {
+	p := RetryPolicy{BackoffBase: 2 * time.Millisecond, MaxBackoff: 100 * time.Millisecond, DisableJitter: true}
+	assert.Equal(t, 64*time.Millisecond, p.delay(5))
+	assert.Equal(t, 100*time.Millisecond, p.delay(6))
+
+	for _, jitter := range []bool{false, true} {
+		p.DisableJitter = !jitter
+		for try := 0; try < 200; try++ {
+			d := p.delay(try)
+			assert.True(t, d > 0 && d <= p.MaxBackoff, "delay %v for attempt %d", d, try)
+		}
+	}
+
+	// unset MaxBackoff falls back to the default cap
+	p = RetryPolicy{BackoffBase: time.Second, DisableJitter: true}
+	assert.Equal(t, DefaultMaxBackoff, p.delay(1000))
+}
+
+func Test_Backoffs(t *testing.T) {
+	sequence := func(b Backoff) []time.Duration {
+		var delays []time.Duration
+		for try := 0; try < 5; try++ {
+			delays = append(delays, b.NextDelay(try))
+		}
+		return delays
+	}
+	ms := time.Millisecond
+
+	assert.Equal(t, []time.Duration{10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms}, sequence(ConstantBackoff{Delay: 10 * ms}))
+	assert.Equal(t, []time.Duration{10 * ms, 20 * ms, 30 * ms, 35 * ms, 35 * ms}, sequence(LinearBackoff{Step: 10 * ms, Max: 35 * ms}))
+	assert.Equal(t, []time.Duration{10 * ms, 20 * ms, 40 * ms, 80 * ms, 100 * ms}, sequence(ExponentialBackoff{Base: 10 * ms, Max: 100 * ms, DisableJitter: true}))
+	assert.Equal(t, DefaultMaxBackoff, LinearBackoff{Step: time.Second}.NextDelay(1<<62))
+
+	// the default policy's delays are the exponential ones
+	def := DefaultRetryPolicy()
+	def.Rand = rand.New(rand.NewSource(7))
+	exp := ExponentialBackoff{Base: def.BackoffBase, Max: def.MaxBackoff, Rand: rand.New(rand.NewSource(7))}
+	assert.Equal(t, sequence(exp), sequence(BackoffFunc(def.delay)))
+}
+
+func Test_RetryUsesBackoff(t *testing.T) {
+	var waited []time.Duration
+	orig := wait
+	wait = func(ctx context.Context, d time.Duration) error {
+		waited = append(waited, d)
+		return nil
+	}
+	defer func() { wait = orig }()
+
+	policy := RetryPolicy{MaxRetries: 4, Timeout: time.Second, Backoff: LinearBackoff{Step: time.Millisecond}}
+	assert.Error(t, NewRegistry(timeoutKeysAPI(), WithRetryPolicy(policy)).Register("serviceA", 1))
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond}, waited)
+}
+
+// countWaits replaces the backoff with one that only counts its calls.
+func countWaits() (*int, func()) {
+	n := 0
+	orig := wait
+	wait = func(ctx context.Context, d time.Duration) error {
+		n++
+		return nil
+	}
+	return &n, func() { wait = orig }
+}
+
+func Test_RetryWaitsOnlyBetweenAttempts(t *testing.T) {
+	waits, restore := countWaits()
+	defer restore()
+
+	r := NewRegistry(NewMemoryBackend())
+	assert.NoError(t, r.Register("serviceA", 1))
+	_, err := r.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, *waits)
+
+	kapi := timeoutKeysAPI()
+	_, err = NewRegistry(kapi).Services()
+	assert.Error(t, err)
+	assert.Equal(t, MaxRetries, kapi.gets)
+	assert.Equal(t, MaxRetries-1, *waits)
+}
+
+// hangingKeysAPI returns a fake whose gets block until their context is done.
+func hangingKeysAPI() *fakeKeysAPI {
+	return &fakeKeysAPI{get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}
+}
+
+func Test_RetryOperationDeadline(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 100, Timeout: 20 * time.Millisecond, BackoffBase: time.Millisecond}
+
+	// a deadline on the caller's context
+	kapi := hangingKeysAPI()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := NewRegistry(kapi, WithRetryPolicy(policy)).ServicesContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second, "took %v", time.Since(start))
+	assert.True(t, kapi.gets < 100, "made %d attempts", kapi.gets)
+
+	// the policy's own bound, for callers without a context
+	kapi = hangingKeysAPI()
+	policy.MaxElapsed = 100 * time.Millisecond
+	start = time.Now()
+	_, err = NewRegistry(kapi, WithRetryPolicy(policy)).Services()
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second, "took %v", time.Since(start))
+	assert.True(t, kapi.gets < 100, "made %d attempts", kapi.gets)
+}
+
+func Test_RetryAttemptFollowsParent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	var attempt context.Context
+	kapi := &fakeKeysAPI{get: func(reqCtx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+		attempt = reqCtx
+		close(started)
+		<-reqCtx.Done()
+		return nil, reqCtx.Err()
+	}}
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	r := NewRegistry(kapi, WithRetryPolicy(RetryPolicy{MaxRetries: 3, Timeout: time.Minute, BackoffBase: time.Millisecond}))
+	_, err := r.ServicesContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, kapi.gets)
+	if assert.NotNil(t, attempt) {
+		assert.Equal(t, context.Canceled, attempt.Err())
+	}
+}
+
+func Test_RetryErrorCountsAttempts(t *testing.T) {
+	_, restore := countWaits()
+	defer restore()
+
+	kapi := timeoutKeysAPI()
+	err := NewRegistry(kapi).Register("serviceA", 1)
+
+	var rerr *RetryError
+	if assert.True(t, errors.As(err, &rerr)) {
+		assert.Equal(t, "registration", rerr.Op)
+		assert.Equal(t, MaxRetries, rerr.AttemptCount)
+		assert.Equal(t, kapi.sets, rerr.AttemptCount)
+		assert.True(t, rerr.TotalElapsed > 0)
+	}
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// failures that aren't retried come back as they are
+	denied := client.Error{Code: client.ErrorCodeUnauthorized}
+	err = NewRegistry(&fakeKeysAPI{set: func(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+		return nil, denied
+	}}).Register("serviceA", 1)
+	assert.Equal(t, denied, err)
+}
+
+func Test_CancelDuringBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 3, Timeout: time.Second, BackoffBase: time.Hour, MaxBackoff: time.Hour}
+	r := NewRegistry(timeoutKeysAPI(), WithRetryPolicy(policy))
+
+	calls := map[string]func(context.Context) error{
+		"register":   func(ctx context.Context) error { return r.RegisterContext(ctx, "serviceA", 1) },
+		"unregister": func(ctx context.Context) error { return r.UnregisterContext(ctx, "serviceA", 1) },
+		"services": func(ctx context.Context) error {
+			_, err := r.ServicesContext(ctx)
+			return err
+		},
+	}
+	for name, call := range calls {
+		// the first attempt times out at once, so this lands in the wait
+		ctx, cancel := context.WithCancel(context.Background())
+		timer := time.AfterFunc(20*time.Millisecond, cancel)
+
+		start := time.Now()
+		assert.Equal(t, context.Canceled, call(ctx), name)
+		assert.True(t, time.Since(start) < time.Second, "%s took %v", name, time.Since(start))
+		timer.Stop()
+		cancel()
+	}
+}
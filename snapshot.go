@@ -0,0 +1,246 @@
+package portmapper
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// Snapshot is an in-memory copy of the registry that a watch keeps up to
+// date, for consumers that read far more often than services change. Reads
+// never go to etcd, so they may lag it slightly.
+type Snapshot struct {
+	r *Registry
+
+	// index is the etcd index the snapshot is current to. It is only
+	// touched by the goroutine following the watch.
+	index uint64
+
+	// entries holds the decoded services by etcd key, guarded by mu
+	mu       sync.RWMutex
+	entries  map[string]*Service
+	lastSync time.Time
+	stopped  bool
+}
+
+// NewSnapshot reads the whole of r's registry and then follows its changes
+// in the background until ctx is done or r is closed. If the watch fails,
+// for instance because etcd has discarded the changes it would resume from,
+// the snapshot is rebuilt from a fresh read with r's backoff between
+// attempts. It returns an error if the first read fails.
+func NewSnapshot(ctx context.Context, r *Registry) (*Snapshot, error) {
+	if err := r.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	s := &Snapshot{r: r}
+	if err := s.sync(ctx); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := r.bind(ctx)
+	started := r.spawn(func() {
+		defer cancel()
+		defer s.stop()
+
+		s.run(ctx)
+	})
+	if !started {
+		cancel()
+		return nil, ErrClosed
+	}
+
+	return s, nil
+}
+
+// Services returns every service in the snapshot, sorted as Registry.Services
+// sorts them. Once the snapshot has stopped following etcd it returns
+// ErrClosed.
+func (s *Snapshot) Services() ([]*Service, error) {
+	return s.filter(func(*Service) bool { return true })
+}
+
+// GetService returns every instance of the named service in the snapshot.
+func (s *Snapshot) GetService(name string) ([]*Service, error) {
+	return s.filter(func(svc *Service) bool { return svc.Name == name })
+}
+
+// LastSync returns when the snapshot was last rebuilt from a full read of
+// etcd. Changes seen through the watch since then don't move it.
+func (s *Snapshot) LastSync() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lastSync
+}
+
+// filter returns copies of the services in the snapshot for which keep
+// returns true. Like decodeServices it passes on only the first of several
+// Equal entries, in key order.
+func (s *Snapshot) filter(keep func(*Service) bool) ([]*Service, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.stopped {
+		return nil, ErrClosed
+	}
+
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := make(map[serviceID]bool, len(keys))
+	matches := []*Service{}
+	for _, key := range keys {
+		svc := s.entries[key]
+		if seen[svc.id()] || !keep(svc) {
+			continue
+		}
+		seen[svc.id()] = true
+		matches = append(matches, svc.Clone())
+	}
+	sortServices(matches)
+
+	return matches, nil
+}
+
+// sync replaces the snapshot's entries with a full read of the registry.
+func (s *Snapshot) sync(ctx context.Context) error {
+	nodes, index, err := s.r.serviceNodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]*Service, len(nodes))
+	for _, node := range nodes {
+		if svc, ok := s.decode(node); ok {
+			entries[node.Key] = svc
+		}
+	}
+
+	s.mu.Lock()
+	s.entries = entries
+	s.lastSync = time.Now()
+	s.mu.Unlock()
+
+	s.index = index
+	return nil
+}
+
+// run follows the registry's changes, rebuilding the snapshot whenever the
+// watch fails, until ctx is done.
+func (s *Snapshot) run(ctx context.Context) {
+	policy := s.r.retryPolicy()
+	failures := 0
+	for {
+		progressed, err := s.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if progressed {
+			failures = 0
+		}
+		logger().Warn("Snapshot watch failed. Rebuilding", Fields{
+			"action":  "Snapshot",
+			"attempt": failures,
+			"errstr":  err.Error(),
+		})
+
+		if wait(ctx, policy.delay(failures)) != nil {
+			return
+		}
+		failures++
+		if err := s.sync(ctx); err != nil && ctx.Err() == nil {
+			logger().Warn("Snapshot rebuild failed. Retrying", Fields{
+				"action":  "Snapshot",
+				"attempt": failures,
+				"errstr":  err.Error(),
+			})
+		}
+	}
+}
+
+// follow applies changes after s.index until the watch fails, reporting
+// whether it applied any.
+func (s *Snapshot) follow(ctx context.Context) (bool, error) {
+	w := s.r.backend.Watcher(s.r.root(), &client.WatcherOptions{Recursive: true, AfterIndex: s.index})
+	progressed := false
+	for {
+		resp, err := w.Next(ctx)
+		if err != nil {
+			return progressed, err
+		}
+		progressed = true
+		if resp.Node == nil {
+			continue
+		}
+		if resp.Node.ModifiedIndex > s.index {
+			s.index = resp.Node.ModifiedIndex
+		}
+		s.apply(resp)
+	}
+}
+
+// apply updates the snapshot with a single watch response.
+func (s *Snapshot) apply(resp *client.Response) {
+	key := resp.Node.Key
+
+	switch resp.Action {
+	case "set", "create", "update", "compareAndSwap":
+		if resp.Node.Dir {
+			return
+		}
+		svc, ok := s.decode(resp.Node)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if ok {
+			s.entries[key] = svc
+		} else {
+			delete(s.entries, key)
+		}
+	case "delete", "expire", "compareAndDelete":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// etcd reports a recursive delete once, for the directory
+		delete(s.entries, key)
+		for k := range s.entries {
+			if strings.HasPrefix(k, key+"/") {
+				delete(s.entries, k)
+			}
+		}
+	}
+}
+
+// decode returns the valid service at node, logging and skipping it otherwise.
+func (s *Snapshot) decode(node *client.Node) (*Service, bool) {
+	svc, err := serviceFromNode(s.r.root(), s.r.codec, node)
+	if err == nil {
+		err = svc.Validate()
+	}
+	if err != nil {
+		logger().Warn("Skipping malformed service entry", Fields{
+			"action": "Snapshot",
+			"key":    node.Key,
+			"errstr": err.Error(),
+		})
+		return nil, false
+	}
+
+	return svc, true
+}
+
+// stop marks the snapshot as no longer following etcd.
+func (s *Snapshot) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+}
@@ -0,0 +1,100 @@
+package portmapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// names returns each of services as a String, or err's text.
+func names(services []*Service, err error) []string {
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var got []string
+	for _, svc := range services {
+		got = append(got, svc.String())
+	}
+	return got
+}
+
+func Test_Snapshot(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	r := NewInMemoryRegistry()
+	defer r.Close()
+	assert.NoError(t, r.Register("serviceA", 1))
+	assert.NoError(t, r.Register("serviceB", 2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewSnapshot(ctx, r)
+	assert.NoError(t, err)
+	assert.False(t, s.LastSync().IsZero())
+	assert.Equal(t, []string{"serviceA:1/tcp@host1", "serviceB:2/tcp@host1"}, names(s.Services()))
+
+	assert.NoError(t, r.Register("serviceB", 3))
+	assert.NoError(t, r.Unregister("serviceA", 1))
+	assert.Eventually(t, func() bool {
+		return len(names(s.Services())) == 2 && names(s.Services())[0] == "serviceB:2/tcp@host1"
+	}, time.Second, time.Millisecond, "snapshot did not follow the changes")
+	assert.Equal(t, []string{"serviceB:2/tcp@host1", "serviceB:3/tcp@host1"}, names(s.GetService("serviceB")))
+
+	_, err = r.UnregisterService("serviceB")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(names(s.Services())) == 0 }, time.Second, time.Millisecond, "snapshot kept unregistered services")
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, err := s.Services()
+		return err == ErrClosed
+	}, time.Second, time.Millisecond, "snapshot still served after cancel")
+}
+
+func Test_SnapshotRebuildsOnReset(t *testing.T) {
+	_, restore := countWaits()
+	defer restore()
+
+	svcA := &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP}
+	svcB := &Service{Name: "serviceB", Port: 2, Protocol: ProtocolTCP}
+	registered := []*Service{svcA}
+	gets := make(chan struct{}, 2)
+	kapi := &fakeKeysAPI{
+		get: func(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+			resp, err := registryGet(registered...)(ctx, key, opts)
+			gets <- struct{}{}
+			return resp, err
+		},
+		watcher: func(key string, opts *client.WatcherOptions) client.Watcher {
+			// serviceB shows up while the first watch is failing, so
+			// only a rebuild can pick it up
+			if len(registered) == 1 {
+				registered = append(registered, svcB)
+				return &fakeWatcher{err: client.Error{Code: client.ErrorCodeEventIndexCleared}}
+			}
+			return &fakeWatcher{}
+		},
+	}
+	r := NewRegistry(kapi)
+	defer r.Close()
+
+	s, err := NewSnapshot(context.Background(), r)
+	assert.NoError(t, err)
+	first := s.LastSync()
+
+	<-gets
+	select {
+	case <-gets:
+	case <-time.After(time.Second):
+		t.Fatal("snapshot was not rebuilt")
+	}
+	assert.Eventually(t, func() bool { return len(names(s.Services())) == 2 }, time.Second, time.Millisecond, "snapshot missed the rebuild")
+	assert.Equal(t, []string{"serviceA:1/tcp", "serviceB:2/tcp"}, names(s.Services()))
+	assert.False(t, s.LastSync().Before(first))
+
+	r.Close()
+	_, err = s.Services()
+	assert.Equal(t, ErrClosed, err)
+}
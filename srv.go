@@ -0,0 +1,52 @@
+package portmapper
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SRV is a DNS SRV record pointing at one registered instance of a service.
+type SRV struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+// SRVName returns the owner name of svc's SRV records, such as _api._tcp.
+// The caller appends its own domain.
+func SRVName(svc *Service) string {
+	return fmt.Sprintf("_%s._%s", svc.Name, svc.protocol())
+}
+
+// SRVRecords groups services into SRV record sets keyed by SRVName. Services
+// without a Hostname have no target to point at and are skipped. Each set is
+// sorted by target then port, and takes its priority and weight from the
+// service.
+func SRVRecords(services []*Service) map[string][]*SRV {
+	records := make(map[string][]*SRV)
+	for _, svc := range services {
+		if svc.Hostname == "" {
+			continue
+		}
+
+		name := SRVName(svc)
+		records[name] = append(records[name], &SRV{
+			Target:   svc.Hostname,
+			Port:     uint16(svc.Port),
+			Priority: uint16(svc.Priority),
+			Weight:   uint16(svc.Weight),
+		})
+	}
+
+	for _, set := range records {
+		sort.Slice(set, func(i, j int) bool {
+			if set[i].Target != set[j].Target {
+				return set[i].Target < set[j].Target
+			}
+			return set[i].Port < set[j].Port
+		})
+	}
+
+	return records
+}
@@ -0,0 +1,33 @@
+package portmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SRVRecords(t *testing.T) {
+	records := SRVRecords([]*Service{
+		{Name: "api", Port: 8080, Protocol: ProtocolTCP, Hostname: "host2"},
+		{Name: "api", Port: 8080, Protocol: ProtocolTCP, Hostname: "host1"},
+		{Name: "api", Port: 9090, Hostname: "host1", Weight: 10, Priority: 1},
+		{Name: "api", Port: 8080, Protocol: ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: ProtocolUDP, Hostname: "host3"},
+	})
+
+	assert.Equal(t, map[string][]*SRV{
+		"_api._tcp": {
+			{Target: "host1", Port: 8080},
+			{Target: "host1", Port: 9090, Priority: 1, Weight: 10},
+			{Target: "host2", Port: 8080},
+		},
+		"_dns._udp": {
+			{Target: "host3", Port: 53},
+		},
+	}, records)
+}
+
+func Test_SRVRecordsNoHostnames(t *testing.T) {
+	records := SRVRecords([]*Service{{Name: "api", Port: 8080}})
+	assert.Equal(t, 0, len(records))
+}
@@ -0,0 +1,70 @@
+package portmapper
+
+import (
+	"golang.org/x/net/context"
+)
+
+// DeregisterStale deletes every registered service for which live returns
+// false and returns how many were deleted. It is meant for clearing out
+// entries left behind by hosts that crashed, with live being whatever
+// reachability check the caller trusts. Entries that can't be decoded are
+// left alone, as are ones that disappear before they can be deleted.
+func (r *Registry) DeregisterStale(ctx context.Context, live func(*Service) bool) (int, error) {
+	if err := r.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	nodes, _, err := r.serviceNodes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, node := range nodes {
+		// decode each entry on its own, since the key may be the older flat
+		// one rather than r.path(svc)
+		svc, err := serviceFromNode(r.root(), r.codec, node)
+		if err == nil {
+			err = svc.Validate()
+		}
+		if err != nil || live(svc) {
+			continue
+		}
+
+		fields := Fields{
+			"action":  "DeregisterStale",
+			"service": svc.Name,
+			"port":    svc.Port,
+			"path":    node.Key,
+		}
+		if r.dryRun {
+			logger().Info("Dry run: not removing stale service from etcd", fields)
+			removed++
+			continue
+		}
+
+		gone := false
+		err = r.retry(ctx, "deletion", fields, func(ctx context.Context) error {
+			_, err := r.backend.Delete(ctx, node.Key, nil)
+			if isKeyNotFound(err) {
+				gone = true
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			r.hooks.failed("unregister", err)
+			return removed, err
+		}
+		r.disown(node.Key)
+		if gone {
+			continue
+		}
+
+		r.hooks.unregistered(svc)
+		logger().Info("Removed stale service from etcd", fields)
+		removed++
+	}
+
+	return removed, nil
+}
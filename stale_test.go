@@ -0,0 +1,40 @@
+package portmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_DeregisterStale(t *testing.T) {
+	backend := NewMemoryBackend()
+	r := NewRegistry(backend)
+	for i, host := range []string{"host1", "host2"} {
+		assert.NoError(t, r.RegisterWithHostname("serviceA", 10+i, host))
+		assert.NoError(t, r.RegisterWithHostname("serviceB", 20+i, host))
+	}
+	// an entry under the older flat layout
+	backend.entries[RegistryPath+"/serviceC:3"] = &memEntry{value: `{"name":"serviceC","port":3,"hostname":"host2"}`}
+
+	removed, err := r.DeregisterStale(context.Background(), func(svc *Service) bool {
+		return svc.Hostname == "host1"
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, removed)
+
+	services, err := r.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 2) {
+		for _, svc := range services {
+			assert.Equal(t, "host1", svc.Hostname)
+		}
+	}
+
+	// nothing left to remove
+	removed, err = r.DeregisterStale(context.Background(), func(svc *Service) bool {
+		return svc.Hostname == "host1"
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+}
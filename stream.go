@@ -0,0 +1,50 @@
+package portmapper
+
+import (
+	"golang.org/x/net/context"
+)
+
+// ServicesStream is like ServicesContext but delivers services one at a time
+// as their entries are decoded, so a large registry needn't be held as one
+// slice. etcd v2 returns the registry in a single response, which is still
+// read whole; only the decoded services are streamed.
+//
+// Both channels are closed once the last service has been sent, ctx is done
+// or the registry is closed. An error, at most one, is sent on the error
+// channel before it closes: ctx's error if the stream was cut short, or the
+// failure to read the registry.
+func (r *Registry) ServicesStream(ctx context.Context) (<-chan *Service, <-chan error) {
+	services := make(chan *Service)
+	errs := make(chan error, 1)
+
+	ctx, cancel := r.bind(ctx)
+	started := r.spawn(func() {
+		defer cancel()
+		defer close(errs)
+		defer close(services)
+
+		svcNodes, _, err := r.serviceNodes(ctx)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		r.decodeServices(svcNodes, func(svc *Service) bool {
+			select {
+			case services <- svc:
+				return true
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return false
+			}
+		})
+	})
+	if !started {
+		cancel()
+		errs <- ErrClosed
+		close(errs)
+		close(services)
+	}
+
+	return services, errs
+}
@@ -0,0 +1,66 @@
+package portmapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_ServicesStream(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceA", Port: 1, Hostname: "host1"},
+		&Service{Name: "serviceB", Port: 2, Hostname: "host1"},
+		&Service{Name: "serviceC", Port: 3, Hostname: "host1"},
+	)})
+
+	services, errs := r.ServicesStream(context.Background())
+
+	var names []string
+	for svc := range services {
+		names = append(names, svc.Name)
+	}
+	assert.Equal(t, []string{"serviceA", "serviceB", "serviceC"}, names)
+
+	err, open := <-errs
+	assert.NoError(t, err)
+	assert.False(t, open)
+}
+
+func Test_ServicesStreamStopsOnCancel(t *testing.T) {
+	r := NewRegistry(&fakeKeysAPI{get: registryGet(
+		&Service{Name: "serviceA", Port: 1, Hostname: "host1"},
+		&Service{Name: "serviceB", Port: 2, Hostname: "host1"},
+	)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	services, errs := r.ServicesStream(ctx)
+
+	// services arrive one at a time: the second isn't sent until asked for
+	svc := <-services
+	assert.Equal(t, "serviceA", svc.Name)
+	cancel()
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("stream didn't stop after cancel")
+	}
+	_, open := <-services
+	assert.False(t, open)
+}
+
+func Test_ServicesStreamError(t *testing.T) {
+	r := NewRegistry(timeoutKeysAPI(), WithRetryPolicy(RetryPolicy{MaxRetries: 1, Timeout: time.Second}))
+
+	services, errs := r.ServicesStream(context.Background())
+	_, open := <-services
+	assert.False(t, open)
+	assert.Error(t, <-errs)
+
+	r.Close()
+	_, errs = r.ServicesStream(context.Background())
+	assert.Equal(t, ErrClosed, <-errs)
+}
@@ -0,0 +1,50 @@
+package portmapper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// SetTLSConfig makes the package-level functions talk to etcd over TLS using
+// c. Passing nil restores the default plaintext transport. Like SetEndpoints it
+// must be called before the first Register, Unregister or Services call.
+func SetTLSConfig(c *tls.Config) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	tlsConfig = c
+	cfg.Transport = currentTransport()
+	defaultReg = nil
+}
+
+// NewTLSConfig builds a client TLS config trusting the PEM encoded CA in
+// caFile and presenting the certificate and key in certFile and keyFile. Any
+// of the files may be empty to leave that part unset.
+func NewTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	c := &tls.Config{}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,73 @@
+package portmapper
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/coreos/etcd/client"
+)
+
+// DefaultDialTimeout bounds connecting to an etcd endpoint unless
+// SetDialTimeout says otherwise. It matches client.DefaultTransport.
+const DefaultDialTimeout = 30 * time.Second
+
+// the settings cfg.Transport is built from, guarded by defaultMu
+var (
+	tlsConfig   *tls.Config
+	dialTimeout = DefaultDialTimeout
+)
+
+// SetDialTimeout bounds how long the package-level functions wait to connect
+// to an etcd endpoint, separately from the per-request timeout, which only
+// starts once a connection is up. Without it a down node can hold each
+// attempt for the OS connect timeout. Zero or less restores
+// DefaultDialTimeout. Like SetEndpoints it must be called before the first
+// Register, Unregister or Services call.
+func SetDialTimeout(d time.Duration) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if d <= 0 {
+		d = DefaultDialTimeout
+	}
+	dialTimeout = d
+	cfg.Transport = currentTransport()
+	defaultReg = nil
+}
+
+// currentTransport returns the transport for the current TLS config and dial
+// timeout: client.DefaultTransport if both are the defaults. The caller holds
+// defaultMu.
+func currentTransport() client.CancelableTransport {
+	if tlsConfig == nil && dialTimeout == DefaultDialTimeout {
+		return client.DefaultTransport
+	}
+	return newTransport(tlsConfig, dialTimeout)
+}
+
+// transport is an http.Transport that keeps the dialer it connects with.
+type transport struct {
+	*http.Transport
+	dialer *net.Dialer
+}
+
+// newTransport mirrors client.DefaultTransport with c as the TLS config and
+// connections bounded by dial.
+func newTransport(c *tls.Config, dial time.Duration) *transport {
+	dialer := &net.Dialer{
+		Timeout:   dial,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &transport{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     c,
+		},
+		dialer: dialer,
+	}
+}
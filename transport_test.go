@@ -0,0 +1,35 @@
+package portmapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SetDialTimeout(t *testing.T) {
+	defer useConfig(cfg)()
+
+	SetDialTimeout(500 * time.Millisecond)
+	tr, ok := cfg.Transport.(*transport)
+	if assert.True(t, ok) {
+		assert.Equal(t, 500*time.Millisecond, tr.dialer.Timeout)
+		assert.Nil(t, tr.TLSClientConfig)
+	}
+
+	// TLS keeps the dial timeout, and the other way round
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	c, err := NewTLSConfig(certFile, certFile, keyFile)
+	assert.NoError(t, err)
+	SetTLSConfig(c)
+	SetDialTimeout(time.Second)
+	if tr, ok := cfg.Transport.(*transport); assert.True(t, ok) {
+		assert.Equal(t, time.Second, tr.dialer.Timeout)
+		assert.Equal(t, c, tr.TLSClientConfig)
+	}
+
+	SetTLSConfig(nil)
+	SetDialTimeout(0)
+	assert.Equal(t, client.DefaultTransport, cfg.Transport)
+}
@@ -0,0 +1,234 @@
+package portmapper
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// EventType says how a registration changed.
+type EventType int
+
+const (
+	// Added is sent when a service is registered for the first time.
+	Added EventType = iota
+	// Modified is sent when an existing registration is overwritten.
+	Modified
+	// Deleted is sent when a registration is removed or expires.
+	Deleted
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Added:
+		return "Added"
+	case Modified:
+		return "Modified"
+	case Deleted:
+		return "Deleted"
+	}
+	return "Unknown"
+}
+
+// ServiceEvent is a change to a single registration.
+type ServiceEvent struct {
+	Type    EventType
+	Service *Service
+}
+
+// Watch streams changes to the registry until ctx is done, the registry is
+// closed or the etcd watcher fails for good, at which point the channel is
+// closed. Transient failures, such as a lost connection, are retried with the
+// registry's backoff and the watch resumes after the last change it saw. If
+// etcd has already discarded that far back, the watch resumes from its
+// current index and the changes in between are lost. etcd reports a whole
+// service removed at once, as by UnregisterService, as a single change, so
+// Deleted events are sent only for the instances the watch has seen.
+func (r *Registry) Watch(ctx context.Context) (<-chan ServiceEvent, error) {
+	return r.watch(ctx, func(ServiceEvent) bool { return true })
+}
+
+// WatchService is like Watch but only delivers events for the named service.
+// The service needn't be registered yet; its first registration arrives as
+// an Added event.
+func (r *Registry) WatchService(ctx context.Context, name string) (<-chan ServiceEvent, error) {
+	return r.watch(ctx, func(event ServiceEvent) bool { return event.Service.Name == name })
+}
+
+// watch streams the registry's events for which keep returns true.
+func (r *Registry) watch(ctx context.Context, keep func(ServiceEvent) bool) (<-chan ServiceEvent, error) {
+	if err := r.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	w := r.backend.Watcher(r.root(), &client.WatcherOptions{Recursive: true})
+	events := make(chan ServiceEvent)
+	policy := r.retryPolicy()
+
+	ctx, cancel := r.bind(ctx)
+	started := r.spawn(func() {
+		defer cancel()
+		defer close(events)
+
+		var after uint64
+		failures := 0
+		seen := watchedServices{}
+		for {
+			resp, err := w.Next(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				fields := Fields{
+					"action":  "Watch",
+					"attempt": failures,
+					"errstr":  err.Error(),
+				}
+				if !watchRecoverable(err) {
+					logger().Error("Service watch failed.", fields)
+					return
+				}
+
+				if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeEventIndexCleared {
+					logger().Warn("Service watch fell behind. Changes may have been missed", fields)
+					after = cerr.Index
+				} else {
+					logger().Warn("Service watch failed. Retrying", fields)
+				}
+
+				if wait(ctx, policy.delay(failures)) != nil {
+					return
+				}
+				failures++
+				w = r.backend.Watcher(r.root(), &client.WatcherOptions{Recursive: true, AfterIndex: after})
+				continue
+			}
+			failures = 0
+			if resp.Node != nil && resp.Node.ModifiedIndex > after {
+				after = resp.Node.ModifiedIndex
+			}
+
+			for _, event := range seen.events(r.root(), r.codec, resp) {
+				if !keep(event) {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	})
+	if !started {
+		cancel()
+		return nil, ErrClosed
+	}
+
+	return events, nil
+}
+
+// watchRecoverable reports whether a watch that failed with err should be
+// recreated. etcd's own errors are final, bar having fallen too far behind;
+// anything else, such as a network or cluster error, may pass.
+func watchRecoverable(err error) bool {
+	if cerr, ok := err.(client.Error); ok {
+		return cerr.Code == client.ErrorCodeEventIndexCleared
+	}
+	return true
+}
+
+// watchedServices holds the services a watch has seen, by key. etcd reports
+// a recursive delete, such as UnregisterService's, once for the directory,
+// so the services below it are only known from what was seen before.
+type watchedServices map[string]*Service
+
+// events returns the ServiceEvents resp amounts to, a Deleted event for each
+// service seen below a deleted directory, and updates seen to match.
+func (seen watchedServices) events(root string, codec Codec, resp *client.Response) []ServiceEvent {
+	if resp.Node == nil {
+		return nil
+	}
+	key := resp.Node.Key
+
+	switch resp.Action {
+	case "delete", "expire", "compareAndDelete":
+		if !resp.Node.Dir {
+			break
+		}
+		var keys []string
+		for k := range seen {
+			if strings.HasPrefix(k, key+"/") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		events := make([]ServiceEvent, len(keys))
+		for i, k := range keys {
+			events[i] = ServiceEvent{Type: Deleted, Service: seen[k]}
+			delete(seen, k)
+		}
+		return events
+	}
+
+	event, ok := toServiceEvent(root, codec, resp)
+	if !ok || event.Type == Deleted {
+		delete(seen, key)
+	} else {
+		seen[key] = event.Service
+	}
+	if !ok {
+		return nil
+	}
+	return []ServiceEvent{event}
+}
+
+// toServiceEvent converts a watch response below root, with values encoded
+// by codec, into a ServiceEvent.
+// It returns false for responses that don't describe a single service, such
+// as directory changes or values that won't unmarshal.
+func toServiceEvent(root string, codec Codec, resp *client.Response) (ServiceEvent, bool) {
+	var (
+		event ServiceEvent
+		node  *client.Node
+	)
+
+	switch resp.Action {
+	case "set", "create", "update", "compareAndSwap":
+		event.Type = Added
+		if resp.PrevNode != nil {
+			event.Type = Modified
+		}
+		node = resp.Node
+	case "delete", "expire", "compareAndDelete":
+		// the deleted node carries no value, so describe it by what it was,
+		// or failing that by its key
+		event.Type = Deleted
+		node = resp.PrevNode
+		if node == nil {
+			node = resp.Node
+		}
+	default:
+		return event, false
+	}
+
+	if node == nil || node.Dir {
+		return event, false
+	}
+
+	svc, err := serviceFromNode(root, codec, node)
+	if err != nil {
+		logger().Warn("Skipping watch event with malformed service.", Fields{
+			"action": "Watch",
+			"key":    node.Key,
+			"errstr": err.Error(),
+		})
+		return event, false
+	}
+
+	event.Service = svc
+	return event, true
+}
@@ -0,0 +1,207 @@
+package portmapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func Test_Watch(t *testing.T) {
+	svcA := &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, SchemaVersion: 1}
+	svcA2 := &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, Hostname: "host2", SchemaVersion: 1}
+	svcB := &Service{Name: "serviceB", Port: 2, Protocol: ProtocolUDP, SchemaVersion: 1}
+
+	var watched *client.WatcherOptions
+	kapi := &fakeKeysAPI{watcher: func(key string, opts *client.WatcherOptions) client.Watcher {
+		watched = opts
+		return &fakeWatcher{responses: []*client.Response{
+			{Action: "set", Node: serviceNode(svcA)},
+			{Action: "set", Node: serviceNode(svcB)},
+			{Action: "set", Node: &client.Node{Key: RegistryPath + "/dir", Dir: true}},
+			{Action: "set", Node: serviceNode(svcA2), PrevNode: serviceNode(svcA)},
+			{Action: "delete", Node: &client.Node{Key: svcB.path()}, PrevNode: serviceNode(svcB)},
+			{Action: "expire", Node: &client.Node{Key: svcA.path()}, PrevNode: serviceNode(svcA2)},
+		}}
+	}}
+	r := NewRegistry(kapi)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := r.Watch(ctx)
+	assert.NoError(t, err)
+	assert.True(t, watched.Recursive)
+
+	expected := []ServiceEvent{
+		{Added, svcA},
+		{Added, svcB},
+		{Modified, svcA2},
+		{Deleted, svcB},
+		{Deleted, svcA2},
+	}
+	for _, want := range expected {
+		select {
+		case got := <-events:
+			assert.Equal(t, want, got)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("events channel not closed after cancel")
+	}
+}
+
+func Test_WatchUnregisterService(t *testing.T) {
+	t.Setenv("HOSTNAME", "host1")
+	r := NewInMemoryRegistry()
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := r.Watch(ctx)
+	assert.NoError(t, err)
+
+	next := func() ServiceEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+		return ServiceEvent{}
+	}
+
+	assert.NoError(t, r.Register("serviceA", 8080))
+	assert.NoError(t, r.Register("serviceA", 8081))
+	assert.NoError(t, r.Register("serviceAB", 8082))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, Added, next().Type)
+	}
+
+	// the directory goes in one delete, reported for each service in it
+	n, err := r.UnregisterService("serviceA")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	for _, port := range []int{8080, 8081} {
+		event := next()
+		assert.Equal(t, Deleted, event.Type)
+		assert.Equal(t, "serviceA", event.Service.Name)
+		assert.Equal(t, port, event.Service.Port)
+	}
+
+	assert.NoError(t, r.Unregister("serviceAB", 8082))
+	event := next()
+	assert.Equal(t, Deleted, event.Type)
+	assert.Equal(t, "serviceAB", event.Service.Name)
+}
+
+func Test_WatchService(t *testing.T) {
+	svcA := &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP, SchemaVersion: 1}
+	svcAB := &Service{Name: "serviceAB", Port: 2, Protocol: ProtocolTCP, SchemaVersion: 1}
+	svcB := &Service{Name: "serviceB", Port: 3, Protocol: ProtocolTCP, SchemaVersion: 1}
+	legacyA := &Service{Name: "serviceA", Port: 4, Protocol: ProtocolTCP, SchemaVersion: 1}
+
+	kapi := &fakeKeysAPI{watcher: func(key string, opts *client.WatcherOptions) client.Watcher {
+		legacy := serviceNode(legacyA)
+		legacy.Key = RegistryPath + "/serviceA:4"
+		return &fakeWatcher{responses: []*client.Response{
+			{Action: "set", Node: serviceNode(svcB)},
+			{Action: "set", Node: serviceNode(svcAB)},
+			{Action: "set", Node: serviceNode(svcA)},
+			{Action: "delete", Node: &client.Node{Key: svcB.path()}, PrevNode: serviceNode(svcB)},
+			{Action: "set", Node: legacy},
+			{Action: "delete", Node: &client.Node{Key: svcA.path()}, PrevNode: serviceNode(svcA)},
+		}}
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := NewRegistry(kapi).WatchService(ctx, "serviceA")
+	assert.NoError(t, err)
+
+	expected := []ServiceEvent{
+		{Added, svcA},
+		{Added, legacyA},
+		{Deleted, svcA},
+	}
+	for _, want := range expected {
+		select {
+		case got := <-events:
+			assert.Equal(t, want, got)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+
+	select {
+	case got := <-events:
+		t.Fatalf("unexpected event %v", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func Test_WatchRecovers(t *testing.T) {
+	waits, restore := countWaits()
+	defer restore()
+
+	nodeAt := func(svc *Service, index uint64) *client.Node {
+		node := serviceNode(svc)
+		node.ModifiedIndex = index
+		return node
+	}
+	svcA := &Service{Name: "serviceA", Port: 1, Protocol: ProtocolTCP}
+	svcB := &Service{Name: "serviceB", Port: 2, Protocol: ProtocolTCP}
+	svcC := &Service{Name: "serviceC", Port: 3, Protocol: ProtocolTCP}
+
+	watchers := []*fakeWatcher{
+		{
+			responses: []*client.Response{{Action: "set", Node: nodeAt(svcA, 5)}},
+			err:       &client.ClusterError{},
+		},
+		{
+			responses: []*client.Response{{Action: "set", Node: nodeAt(svcB, 6)}},
+			err:       client.Error{Code: client.ErrorCodeEventIndexCleared, Index: 20},
+		},
+		{
+			responses: []*client.Response{{Action: "set", Node: nodeAt(svcC, 21)}},
+			err:       client.Error{Code: client.ErrorCodeUnauthorized},
+		},
+	}
+	var after []uint64
+	kapi := &fakeKeysAPI{watcher: func(key string, opts *client.WatcherOptions) client.Watcher {
+		after = append(after, opts.AfterIndex)
+		w := watchers[0]
+		watchers = watchers[1:]
+		return w
+	}}
+
+	events, err := NewRegistry(kapi).Watch(context.Background())
+	assert.NoError(t, err)
+
+	for _, want := range []*Service{svcA, svcB, svcC} {
+		select {
+		case got := <-events:
+			assert.Equal(t, Added, got.Type)
+			assert.Equal(t, want.Name, got.Service.Name)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+
+	// the unauthorized error is final
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("events channel not closed after unrecoverable error")
+	}
+	assert.Equal(t, []uint64{0, 5, 20}, after)
+	assert.Equal(t, 2, *waits)
+}